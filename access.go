@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//
+// Access Lists
+//
+
+// Access decisions for an incoming connection.
+const (
+	accessServe  = "serve"  // Serve and log normally.
+	accessAllow  = "allow"  // Serve and log, exempt from deny rules.
+	accessIgnore = "ignore" // Serve without logging.
+	accessDeny   = "deny"   // Close immediately.
+)
+
+// accessLists are the parsed CIDR lists from the access configuration.
+type accessLists struct {
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+	ignore []*net.IPNet
+}
+
+// currentAccess holds the active lists; it is swapped when the configuration is reloaded.
+var currentAccess atomic.Pointer[accessLists]
+
+// parseCIDRs parses CIDR ranges; a bare IP address is treated as a single-host range.
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// newAccessLists parses the allow, deny and ignore lists of config.
+func newAccessLists(config AccessConfig) (*accessLists, error) {
+	var lists accessLists
+	var err error
+	if lists.allow, err = parseCIDRs(config.Allow); err != nil {
+		return nil, fmt.Errorf("access.allow: %w", err)
+	}
+	if lists.deny, err = parseCIDRs(config.Deny); err != nil {
+		return nil, fmt.Errorf("access.deny: %w", err)
+	}
+	if lists.ignore, err = parseCIDRs(config.Ignore); err != nil {
+		return nil, fmt.Errorf("access.ignore: %w", err)
+	}
+	return &lists, nil
+}
+
+// containsIP reports whether any of the networks contains ip.
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessDecision returns what to do with a connection from host. The ignore list
+// wins over everything, and the allow list exempts addresses from the deny list.
+func accessDecision(host string) string {
+	lists := currentAccess.Load()
+	ip := net.ParseIP(host)
+	if lists == nil || ip == nil {
+		return accessServe
+	}
+	switch {
+	case containsIP(lists.ignore, ip):
+		return accessIgnore
+	case containsIP(lists.allow, ip):
+		return accessAllow
+	case containsIP(lists.deny, ip):
+		return accessDeny
+	}
+	return accessServe
+}
+
+// watchAccessLists polls the configuration file and swaps in new access lists when it
+// changes, so lists can be edited without a restart. Other settings are not reloaded.
+func watchAccessLists(configPath string, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	var lastModified time.Time
+	if info, err := os.Stat(configPath); err == nil {
+		lastModified = info.ModTime()
+	}
+	for range time.Tick(interval) {
+		info, err := os.Stat(configPath)
+		if err != nil || info.ModTime().Equal(lastModified) {
+			continue
+		}
+		lastModified = info.ModTime()
+		config, err := loadConfig(configPath, true)
+		if err != nil {
+			log.Printf("Error reloading access lists: %v", err)
+			continue
+		}
+		lists, err := newAccessLists(config.Access)
+		if err != nil {
+			log.Printf("Error reloading access lists: %v", err)
+			continue
+		}
+		currentAccess.Store(lists)
+		log.Printf("Reloaded access lists from %s (%d allow, %d deny, %d ignore)",
+			configPath, len(lists.allow), len(lists.deny), len(lists.ignore))
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+//
+// Log Analysis
+//
+
+// runAnalyze implements the "analyze" subcommand, which prints reports built from the logs.
+func runAnalyze(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: lovecraft-ftp analyze creds [-file credentials.jsonl] [-top 10]")
+	}
+	switch args[0] {
+	case "creds":
+		flags := flag.NewFlagSet("analyze creds", flag.ExitOnError)
+		file := flags.String("file", "credentials.jsonl", "credential log to analyze")
+		top := flags.Int("top", 10, "number of entries in each top list")
+		flags.Parse(args[1:])
+		entries, err := readCredentialLog(*file)
+		if err != nil {
+			return err
+		}
+		writeCredentialReport(os.Stdout, *file, entries, *top)
+		return nil
+	default:
+		return fmt.Errorf("unknown report %q (available: creds)", args[0])
+	}
+}
+
+// readCredentialLog reads every entry of a credential log, skipping malformed lines.
+func readCredentialLog(fileName string) ([]CredentialLog, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []CredentialLog
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry CredentialLog
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// tally is a value and how often it was seen.
+type tally struct {
+	value string
+	count int
+}
+
+// topCounts returns the n most frequent values, ties broken alphabetically.
+func topCounts(counts map[string]int, n int) []tally {
+	tallies := make([]tally, 0, len(counts))
+	for value, count := range counts {
+		tallies = append(tallies, tally{value, count})
+	}
+	sort.Slice(tallies, func(i, j int) bool {
+		if tallies[i].count != tallies[j].count {
+			return tallies[i].count > tallies[j].count
+		}
+		return tallies[i].value < tallies[j].value
+	})
+	if len(tallies) > n {
+		tallies = tallies[:n]
+	}
+	return tallies
+}
+
+// writeCredentialReport prints the top usernames, passwords and pairs, and the
+// number of never-before-seen pairs per day.
+func writeCredentialReport(out io.Writer, fileName string, entries []CredentialLog, top int) {
+	usernames := make(map[string]int)
+	passwords := make(map[string]int)
+	pairs := make(map[string]int)
+	firstSeen := make(map[string]string)
+	attemptsPerDay := make(map[string]int)
+	successes := 0
+
+	for _, entry := range entries {
+		pair := entry.Username + ":" + entry.Password
+		usernames[entry.Username]++
+		passwords[entry.Password]++
+		pairs[pair]++
+		if entry.Result == "success" || entry.Result == "anonymous" {
+			successes++
+		}
+		day := "unknown"
+		if ts, err := time.Parse(time.RFC3339, entry.Timestamp); err == nil {
+			day = ts.Format("2006-01-02")
+		}
+		attemptsPerDay[day]++
+		if seen, ok := firstSeen[pair]; !ok || day < seen {
+			firstSeen[pair] = day
+		}
+	}
+	newPerDay := make(map[string]int)
+	for _, day := range firstSeen {
+		newPerDay[day]++
+	}
+
+	fmt.Fprintf(out, "Credential report for %s: %d attempts, %d successful, %d distinct pairs\n",
+		fileName, len(entries), successes, len(pairs))
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, section := range []struct {
+		title  string
+		header string
+		counts map[string]int
+	}{
+		{"Top usernames", "USERNAME", usernames},
+		{"Top passwords", "PASSWORD", passwords},
+		{"Top pairs", "USERNAME:PASSWORD", pairs},
+	} {
+		fmt.Fprintf(w, "\n%s\n  COUNT\t%s\n", section.title, section.header)
+		for _, t := range topCounts(section.counts, top) {
+			fmt.Fprintf(w, "  %d\t%q\n", t.count, t.value)
+		}
+	}
+
+	days := make([]string, 0, len(attemptsPerDay))
+	for day := range attemptsPerDay {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	fmt.Fprintf(w, "\nNew pairs per day\n  DATE\tNEW\tATTEMPTS\n")
+	for _, day := range days {
+		fmt.Fprintf(w, "  %s\t%d\t%d\n", day, newPerDay[day], attemptsPerDay[day])
+	}
+	w.Flush()
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//
+// Authentication
+//
+
+// loginState tracks where a session is in the USER/PASS exchange.
+type loginState int
+
+const (
+	stateNeedUser loginState = iota // Waiting for USER.
+	stateNeedPass                   // USER received, waiting for PASS.
+	stateLoggedIn                   // USER and PASS accepted.
+)
+
+// preLoginCommands lists the commands a client may send before logging in.
+// Everything else is answered with 530, as vsftpd and friends do.
+var preLoginCommands = map[string]bool{
+	"USER": true,
+	"PASS": true,
+	"ACCT": true,
+	"CLNT": true,
+	"REIN": true,
+	"QUIT": true,
+}
+
+// requiresLogin reports whether command must be rejected in the current login state.
+func (s *ftpSession) requiresLogin(command string) bool {
+	return s.state != stateLoggedIn && !preLoginCommands[command]
+}
+
+// loginPolicy decides whether a USER/PASS pair coming from host is accepted.
+type loginPolicy interface {
+	accept(host, user, password string) bool
+}
+
+// authPolicy is the login policy built from the configuration at startup.
+var authPolicy loginPolicy
+
+// newLoginPolicy returns the login policy selected by config.
+func newLoginPolicy(config AuthConfig) loginPolicy {
+	switch config.Policy {
+	case "list":
+		return accountListPolicy{accounts: config.Accounts}
+	case "reject-first":
+		return &rejectFirstPolicy{limit: config.RejectFirst, recent: list.New(), attempts: make(map[string]*list.Element)}
+	case "probability":
+		return probabilityPolicy{probability: config.AcceptProbability}
+	case "weak":
+		weak := make(map[string]bool)
+		for _, password := range config.WeakPasswords {
+			weak[password] = true
+		}
+		return weakPasswordPolicy{passwords: weak}
+	default:
+		return acceptAllPolicy{}
+	}
+}
+
+// acceptAllPolicy accepts every login.
+type acceptAllPolicy struct{}
+
+func (acceptAllPolicy) accept(host, user, password string) bool { return true }
+
+// accountListPolicy accepts only the configured accounts.
+type accountListPolicy struct {
+	accounts []Account
+}
+
+func (p accountListPolicy) accept(host, user, password string) bool {
+	for _, account := range p.accounts {
+		if (account.User == "*" || account.User == user) && (account.Password == "*" || account.Password == password) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectFirstHosts is how many source IPs the reject-first policy remembers. The least
+// recently seen ones are forgotten first, and start over if they come back.
+const rejectFirstHosts = 65536
+
+// rejectFirstPolicy refuses the first few attempts from each source IP and accepts
+// everything after that, so that brute-forcers reveal part of their wordlist.
+type rejectFirstPolicy struct {
+	limit    int
+	mu       sync.Mutex
+	recent   *list.List               // Attempt counts, most recently seen host first.
+	attempts map[string]*list.Element // Elements of recent, keyed by host.
+}
+
+// hostAttempts is the number of login attempts seen from a host.
+type hostAttempts struct {
+	host  string
+	count int
+}
+
+func (p *rejectFirstPolicy) accept(host, user, password string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	element, ok := p.attempts[host]
+	if ok {
+		p.recent.MoveToFront(element)
+	} else {
+		element = p.recent.PushFront(&hostAttempts{host: host})
+		p.attempts[host] = element
+		if p.recent.Len() > rejectFirstHosts {
+			oldest := p.recent.Back()
+			p.recent.Remove(oldest)
+			delete(p.attempts, oldest.Value.(*hostAttempts).host)
+		}
+	}
+	seen := element.Value.(*hostAttempts)
+	if seen.count >= p.limit {
+		return true
+	}
+	seen.count++
+	return false
+}
+
+// probabilityPolicy accepts a login at random.
+type probabilityPolicy struct {
+	probability float64
+}
+
+func (p probabilityPolicy) accept(host, user, password string) bool {
+	return rand.Float64() < p.probability
+}
+
+// weakPasswordPolicy rejects everything until a well-known weak password is tried.
+type weakPasswordPolicy struct {
+	passwords map[string]bool
+}
+
+func (p weakPasswordPolicy) accept(host, user, password string) bool {
+	return p.passwords[password]
+}
+
+// failedLoginDelay returns how long to wait before answering a failed login.
+func failedLoginDelay() time.Duration {
+	delay := time.Duration(cfg.Auth.FailDelay)
+	if jitter := int64(cfg.Auth.FailJitter); jitter > 0 {
+		delay += time.Duration(rand.Int63n(jitter))
+	}
+	return delay
+}
+
+// handleUser starts a new login. Sending USER again, even after logging in,
+// restarts the exchange like ProFTPD does.
+func (s *ftpSession) handleUser(argument string) {
+	log.Printf("%s Login attempt: USER %s", s.logPrefix, argument)
+	s.user = argument
+	s.profile = nil
+	s.state = stateNeedPass
+	s.writeLine("331 Username OK, need password.")
+}
+
+// handlePass completes a login started with USER.
+func (s *ftpSession) handlePass(argument string) {
+	switch s.state {
+	case stateNeedUser:
+		// Passwords sprayed without USER are still worth keeping.
+		s.logCredential(argument, "out_of_sequence")
+		s.writeLine("503 Login with USER first.")
+	case stateLoggedIn:
+		s.logCredential(argument, "out_of_sequence")
+		s.writeLine("503 Already logged in.")
+	default:
+		if isAnonymousUser(s.user) {
+			// Anonymous users give their email address as the password.
+			log.Printf("%s Anonymous login (%s)", s.logPrefix, argument)
+			s.logCredential(argument, "anonymous")
+			s.startSession()
+			s.writeLine("230 Login successful.")
+			return
+		}
+		if !authPolicy.accept(s.remoteIP().String(), s.user, argument) {
+			log.Printf("%s Login failed for user %s", s.logPrefix, s.user)
+			s.logCredential(argument, "failure")
+			s.observeBan("login_failure", "")
+			s.failedLogins++
+			s.state = stateNeedUser
+			s.checkTarpitLogin()
+			time.Sleep(failedLoginDelay() + s.tarpitLoginDelay())
+			s.writeLine("530 Login incorrect.")
+			return
+		}
+		log.Printf("%s User %s logged in", s.logPrefix, s.user)
+		s.logCredential(argument, "success")
+		s.startSession()
+		s.writeLine("230 Login successful.")
+	}
+}
+
+// startSession logs the user in with the profile matching their name.
+func (s *ftpSession) startSession() {
+	s.profile = findUserProfile(s.user)
+	s.root = s.profile.rootFor(s.conn.RemoteAddr())
+	s.cwd = s.profile.Home
+	s.state = stateLoggedIn
+}
+
+// handleAcct answers ACCT. No account information is ever required.
+func (s *ftpSession) handleAcct() {
+	switch s.state {
+	case stateNeedUser:
+		s.writeLine("503 Login with USER first.")
+	case stateNeedPass:
+		s.writeLine("503 Login with PASS first.")
+	default:
+		s.writeLine("202 Command not implemented, superfluous at this site.")
+	}
+}
+
+// handleRein reinitializes the session as if the client had just connected.
+func (s *ftpSession) handleRein() {
+	log.Printf("%s Session reinitialized", s.logPrefix)
+	s.closeDataConnection()
+	s.state = stateNeedUser
+	s.user = ""
+	s.profile = nil
+	s.root = nil
+	s.cwd = "/"
+	s.writeLine("220 Service ready for new user.")
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+//
+// Automatic Banning
+//
+
+// Ban is a timed ban of a single IP address.
+type Ban struct {
+	IP      string    `json:"ip"`
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// banFile is the on-disk format of the ban list.
+type banFile struct {
+	Bans []Ban `json:"bans"`
+}
+
+// banEngine counts rule-matching events per IP and bans IPs that cross a rule's threshold.
+// Bans are kept in a JSON file so they survive restarts and can be lifted from the command line.
+type banEngine struct {
+	mu      sync.Mutex
+	file    string
+	rules   []BanRule
+	bans    map[string]Ban
+	hits    map[string][]time.Time // Recent matching events, keyed by rule index and IP.
+	modTime time.Time              // Modification time of file when it was last read or written.
+}
+
+// bans is the ban engine used by the server; nil when banning is disabled.
+var bans *banEngine
+
+// banReloadInterval is how often the ban file is checked for changes made with the bans subcommand.
+const banReloadInterval = 10 * time.Second
+
+// newBanEngine returns a ban engine using the rules and file of config, loading existing bans.
+func newBanEngine(config BansConfig) (*banEngine, error) {
+	engine := &banEngine{
+		file:  config.File,
+		rules: config.Rules,
+		bans:  make(map[string]Ban),
+		hits:  make(map[string][]time.Time),
+	}
+	if err := engine.load(); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+// load replaces the in-memory bans with the contents of the ban file, if it exists.
+// The caller must hold e.mu or be the only user of e.
+func (e *banEngine) load() error {
+	data, err := os.ReadFile(e.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var contents banFile
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return fmt.Errorf("parsing %s: %w", e.file, err)
+	}
+	e.bans = make(map[string]Ban, len(contents.Bans))
+	for _, ban := range contents.Bans {
+		e.bans[ban.IP] = ban
+	}
+	if info, err := os.Stat(e.file); err == nil {
+		e.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// fileChanged reports whether the ban file was modified by someone else since it was last read or written.
+func (e *banEngine) fileChanged() bool {
+	info, err := os.Stat(e.file)
+	return err == nil && !info.ModTime().Equal(e.modTime)
+}
+
+// save writes the unexpired bans to the ban file, replacing it atomically.
+// The caller must hold e.mu or be the only user of e.
+func (e *banEngine) save() error {
+	now := time.Now()
+	contents := banFile{Bans: []Ban{}}
+	for ip, ban := range e.bans {
+		if now.After(ban.Expires) {
+			delete(e.bans, ip)
+			continue
+		}
+		contents.Bans = append(contents.Bans, ban)
+	}
+	sort.Slice(contents.Bans, func(i, j int) bool { return contents.Bans[i].Expires.Before(contents.Bans[j].Expires) })
+	data, err := json.MarshalIndent(contents, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(e.file, append(data, '\n')); err != nil {
+		return err
+	}
+	if info, err := os.Stat(e.file); err == nil {
+		e.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// banned returns the active ban of ip, if there is one.
+func (e *banEngine) banned(ip string) (Ban, bool) {
+	if e == nil {
+		return Ban{}, false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ban, ok := e.bans[ip]
+	if !ok || time.Now().After(ban.Expires) {
+		return Ban{}, false
+	}
+	return ban, true
+}
+
+// observe counts an event from ip against every matching rule and bans the IP
+// when a rule's threshold is reached within its window.
+func (e *banEngine) observe(ip, event, kind string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if ban, ok := e.bans[ip]; ok && time.Now().Before(ban.Expires) {
+		return
+	}
+	now := time.Now()
+	for i, rule := range e.rules {
+		if rule.Event != event || (rule.Kind != "" && rule.Kind != kind) {
+			continue
+		}
+		key := fmt.Sprintf("%d/%s", i, ip)
+		cutoff := now.Add(-time.Duration(rule.Window))
+		recent := e.hits[key][:0]
+		for _, at := range e.hits[key] {
+			if at.After(cutoff) {
+				recent = append(recent, at)
+			}
+		}
+		recent = append(recent, now)
+		if len(recent) < rule.Threshold {
+			e.hits[key] = recent
+			continue
+		}
+		delete(e.hits, key)
+		e.ban(ip, rule.describe(), time.Duration(rule.Duration))
+		return
+	}
+}
+
+// ban adds a ban and persists it. The caller must hold e.mu.
+func (e *banEngine) ban(ip, reason string, duration time.Duration) {
+	if e.fileChanged() {
+		// Someone lifted a ban from the command line; start from their version.
+		if err := e.load(); err != nil {
+			log.Printf("Error reloading bans: %v", err)
+		}
+	}
+	now := time.Now()
+	e.bans[ip] = Ban{IP: ip, Reason: reason, Created: now, Expires: now.Add(duration)}
+	log.Printf("[%s] Banned for %s: %s", ip, duration, reason)
+	logEvent(ip, "", "ban", severityMedium, map[string]any{"reason": reason, "duration": duration.String()})
+	if err := e.save(); err != nil {
+		log.Printf("Error saving bans: %v", err)
+	}
+}
+
+// count returns the number of active bans.
+func (e *banEngine) count() int {
+	if e == nil {
+		return 0
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	active := 0
+	for _, ban := range e.bans {
+		if now.Before(ban.Expires) {
+			active++
+		}
+	}
+	return active
+}
+
+// watch reloads the ban file whenever it is changed by someone else, and forgets
+// event counts that have aged out of every rule window.
+func (e *banEngine) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		e.mu.Lock()
+		if e.fileChanged() {
+			if err := e.load(); err != nil {
+				log.Printf("Error reloading bans: %v", err)
+			} else {
+				log.Printf("Reloaded %d bans from %s", len(e.bans), e.file)
+			}
+		}
+		var longest time.Duration
+		for _, rule := range e.rules {
+			longest = max(longest, time.Duration(rule.Window))
+		}
+		cutoff := time.Now().Add(-longest)
+		for key, hits := range e.hits {
+			if len(hits) == 0 || hits[len(hits)-1].Before(cutoff) {
+				delete(e.hits, key)
+			}
+		}
+		e.mu.Unlock()
+	}
+}
+
+// describe returns a human-readable description of the rule, used as the ban reason.
+func (r BanRule) describe() string {
+	event := r.Event
+	if r.Kind != "" {
+		event += "/" + r.Kind
+	}
+	if r.Threshold <= 1 {
+		return event
+	}
+	return fmt.Sprintf("%d %s in %s", r.Threshold, event, time.Duration(r.Window))
+}
+
+// runBans implements the "bans" subcommand, which lists and lifts bans in the ban file.
+func runBans(args []string) error {
+	const usage = "usage: lovecraft-ftp bans [-file bans.json] list | lift <ip>"
+	flags := flag.NewFlagSet("bans", flag.ExitOnError)
+	file := flags.String("file", defaultConfig().Bans.File, "ban file")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return errors.New(usage)
+	}
+	engine := &banEngine{file: *file, bans: make(map[string]Ban)}
+	if err := engine.load(); err != nil {
+		return err
+	}
+
+	switch flags.Arg(0) {
+	case "list":
+		list := make([]Ban, 0, len(engine.bans))
+		now := time.Now()
+		for _, ban := range engine.bans {
+			if now.Before(ban.Expires) {
+				list = append(list, ban)
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Expires.Before(list[j].Expires) })
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "IP\tBANNED\tEXPIRES\tREASON")
+		for _, ban := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", ban.IP,
+				ban.Created.Local().Format(time.DateTime), ban.Expires.Local().Format(time.DateTime), ban.Reason)
+		}
+		return w.Flush()
+	case "lift":
+		if flags.NArg() != 2 {
+			return errors.New(usage)
+		}
+		ip := flags.Arg(1)
+		if _, ok := engine.bans[ip]; !ok {
+			return fmt.Errorf("%s is not banned", ip)
+		}
+		delete(engine.bans, ip)
+		if err := engine.save(); err != nil {
+			return err
+		}
+		fmt.Printf("Lifted ban on %s\n", ip)
+		return nil
+	default:
+		return errors.New(usage)
+	}
+}
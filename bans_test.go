@@ -0,0 +1,108 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestBanEngine returns a ban engine with the given rules, keeping its file in a temporary directory.
+func newTestBanEngine(t *testing.T, rules ...BanRule) *banEngine {
+	t.Helper()
+	engine, err := newBanEngine(BansConfig{File: filepath.Join(t.TempDir(), "bans.json"), Rules: rules})
+	if err != nil {
+		t.Fatalf("newBanEngine: %v", err)
+	}
+	return engine
+}
+
+func TestBanEngineObserve(t *testing.T) {
+	rule := BanRule{Event: "login_failure", Threshold: 3, Window: Duration(time.Minute), Duration: Duration(time.Hour)}
+	engine := newTestBanEngine(t, rule, BanRule{Event: "dos_attempt", Kind: "oversized_line", Threshold: 1, Duration: Duration(time.Hour)})
+
+	engine.observe("192.0.2.1", "login_failure", "")
+	engine.observe("192.0.2.1", "login_failure", "")
+	engine.observe("192.0.2.2", "login_failure", "")
+	engine.observe("192.0.2.1", "bounce_attempt", "")
+	if _, ok := engine.banned("192.0.2.1"); ok {
+		t.Fatalf("banned after 2 of 3 failures")
+	}
+
+	// Age the recorded failures out of the window; the next one starts a new count.
+	for key, hits := range engine.hits {
+		for i := range hits {
+			hits[i] = hits[i].Add(-2 * time.Duration(rule.Window))
+		}
+		engine.hits[key] = hits
+	}
+	engine.observe("192.0.2.1", "login_failure", "")
+	engine.observe("192.0.2.1", "login_failure", "")
+	if _, ok := engine.banned("192.0.2.1"); ok {
+		t.Fatalf("banned for failures outside the window")
+	}
+	engine.observe("192.0.2.1", "login_failure", "")
+	ban, ok := engine.banned("192.0.2.1")
+	if !ok {
+		t.Fatalf("not banned after 3 failures within the window")
+	}
+	if ban.Reason != rule.describe() || ban.Expires.Sub(ban.Created) != time.Hour {
+		t.Errorf("ban = %+v; want reason %q lasting %s", ban, rule.describe(), time.Duration(rule.Duration))
+	}
+	if _, ok := engine.banned("192.0.2.2"); ok {
+		t.Errorf("192.0.2.2 banned for the failures of 192.0.2.1")
+	}
+
+	engine.observe("192.0.2.3", "dos_attempt", "slow_line")
+	if _, ok := engine.banned("192.0.2.3"); ok {
+		t.Errorf("banned by a rule of another kind")
+	}
+	engine.observe("192.0.2.3", "dos_attempt", "oversized_line")
+	if _, ok := engine.banned("192.0.2.3"); !ok {
+		t.Errorf("not banned by a matching threshold 1 rule")
+	}
+	if got := engine.count(); got != 2 {
+		t.Errorf("count() = %d; want 2", got)
+	}
+
+	var disabled *banEngine
+	disabled.observe("192.0.2.4", "dos_attempt", "oversized_line")
+	if _, ok := disabled.banned("192.0.2.4"); ok {
+		t.Errorf("banned with banning disabled")
+	}
+}
+
+func TestBanEngineLift(t *testing.T) {
+	engine := newTestBanEngine(t, BanRule{Event: "bounce_attempt", Threshold: 1, Duration: Duration(time.Hour)})
+	engine.observe("192.0.2.1", "bounce_attempt", "")
+	engine.observe("192.0.2.2", "bounce_attempt", "")
+	engine.bans["192.0.2.3"] = Ban{IP: "192.0.2.3", Created: time.Now().Add(-2 * time.Hour), Expires: time.Now().Add(-time.Hour)}
+	if err := engine.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	// A restarted server picks the bans up again, minus the expired one.
+	restarted := newTestBanEngine(t)
+	restarted.file = engine.file
+	if err := restarted.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(restarted.bans) != 2 {
+		t.Errorf("loaded %d bans; want 2", len(restarted.bans))
+	}
+
+	if err := runBans([]string{"-file", engine.file, "lift", "192.0.2.1"}); err != nil {
+		t.Fatalf("bans lift: %v", err)
+	}
+	if err := runBans([]string{"-file", engine.file, "lift", "192.0.2.1"}); err == nil {
+		t.Errorf("bans lift of an IP that is not banned succeeded")
+	}
+	if err := engine.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if _, ok := engine.banned("192.0.2.1"); ok {
+		t.Errorf("192.0.2.1 still banned after it was lifted")
+	}
+	if _, ok := engine.banned("192.0.2.2"); !ok {
+		t.Errorf("192.0.2.2 no longer banned after lifting another IP")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//
+// FTP Bounce / FXP Detection
+//
+
+// portRequest records a third-party PORT or EPRT target requested by the client.
+type portRequest struct {
+	host string
+	port int
+	at   time.Time
+}
+
+// remoteIP returns the IP address of the control connection's peer.
+func (s *ftpSession) remoteIP() net.IP {
+	if tcpAddr, ok := s.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// setActiveTarget validates an active mode data address requested with PORT or EPRT.
+// Targets other than the control connection's peer are logged as bounce attempts and
+// are either refused (false is returned) or faked so that no connection is ever dialed.
+func (s *ftpSession) setActiveTarget(command string, ip net.IP, port int) bool {
+	s.closeDataConnection()
+	target := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	peer := s.remoteIP()
+	if peer != nil && peer.Equal(ip) {
+		s.activeDataAddress = target
+		return true
+	}
+
+	log.Printf("%s Bounce attempt: %s to %s", s.logPrefix, command, target)
+	s.logEvent("bounce_attempt", severityHigh, map[string]any{
+		"command": command,
+		"target":  target,
+		"peer":    peer.String(),
+		// A high port on another host usually belongs to a second FTP server's
+		// passive listener, i.e. a server-to-server (FXP) transfer.
+		"fxp":  port >= 1024,
+		"mode": cfg.Bounce.Mode,
+	})
+	s.trackPortScan(ip, port)
+	if cfg.Tarpit.OnBounce {
+		s.enableTarpit("bounce attempt")
+	}
+
+	if cfg.Bounce.Mode == "fake" {
+		s.fakeDataTarget = target
+		return true
+	}
+	return false
+}
+
+// trackPortScan flags sessions that request many distinct ports on third-party hosts,
+// the pattern produced by FTP bounce port scanners.
+func (s *ftpSession) trackPortScan(ip net.IP, port int) {
+	now := time.Now()
+	host := ip.String()
+	cutoff := now.Add(-time.Duration(cfg.Bounce.ScanWindow))
+
+	recent := s.portRequests[:0]
+	for _, req := range s.portRequests {
+		if req.at.After(cutoff) {
+			recent = append(recent, req)
+		}
+	}
+	s.portRequests = append(recent, portRequest{host: host, port: port, at: now})
+
+	ports := make(map[int]bool)
+	for _, req := range s.portRequests {
+		if req.host == host {
+			ports[req.port] = true
+		}
+	}
+	if len(ports) < cfg.Bounce.ScanThreshold || s.portScanFlagged {
+		return
+	}
+	s.portScanFlagged = true
+	portList := make([]int, 0, len(ports))
+	for p := range ports {
+		portList = append(portList, p)
+	}
+	sort.Ints(portList)
+	log.Printf("%s Bounce port scan detected against %s", s.logPrefix, host)
+	s.logEvent("port_scan", severityHigh, map[string]any{
+		"target": host,
+		"ports":  portList,
+		"window": time.Duration(cfg.Bounce.ScanWindow).String(),
+	})
+}
+
+// fakeDataConnection returns a connection that silently discards everything written
+// to it and has nothing to read, used to pretend a bounced transfer succeeded without
+// dialing the target. A STOR from the faked target receives an empty file.
+func fakeDataConnection() net.Conn {
+	local, remote := net.Pipe()
+	go io.Copy(io.Discard, remote)
+	return silentConn{local}
+}
+
+// silentConn is a connection whose peer never sends anything.
+type silentConn struct {
+	net.Conn
+}
+
+func (silentConn) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
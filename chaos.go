@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+)
+
+//
+// Fault Injection
+//
+
+// endFault is the session_end reason for sessions closed by an injected fault.
+const endFault = "fault_injected"
+
+// errTransferDropped is returned when a data transfer is deliberately cut short.
+var errTransferDropped = errors.New("transfer dropped")
+
+// faultReplies are the replies sent for the reply codes that can be injected.
+var faultReplies = map[int]string{
+	421: "421 Service not available, closing control connection.",
+	450: "450 Requested file action not taken.",
+	451: "451 Requested action aborted: local error in processing.",
+	452: "452 Requested action not taken. Insufficient storage space in system.",
+}
+
+// logFault records an injected fault of the given kind.
+func (s *ftpSession) logFault(kind string, details map[string]any) {
+	details["kind"] = kind
+	log.Printf("%s Injected fault: %s", s.logPrefix, kind)
+	s.logEvent("fault_injected", severityInfo, details)
+}
+
+// pickResetAfter chooses after how many commands the control connection will be reset,
+// or zero if it will not be.
+func pickResetAfter() int {
+	low, high := cfg.Chaos.ResetAfterMin, cfg.Chaos.ResetAfterMax
+	if !cfg.Chaos.Enabled || low <= 0 {
+		return 0
+	}
+	if high <= low {
+		return low
+	}
+	return low + rand.Intn(high-low+1)
+}
+
+// injectReset resets the control connection once the session reaches its chosen
+// command count. It reports whether the connection was reset.
+func (s *ftpSession) injectReset() bool {
+	if s.resetAfter == 0 || s.commandCount < s.resetAfter {
+		return false
+	}
+	s.logFault("reset", map[string]any{"commands": s.commandCount})
+	if tcpConn, ok := s.conn.(*net.TCPConn); ok {
+		// Discard unsent data and send an RST instead of a FIN when the connection closes.
+		tcpConn.SetLinger(0)
+	}
+	s.endReason = endFault
+	return true
+}
+
+// injectCommandFault randomly fails a command with one of its configured reply codes.
+// It reports whether a fault was injected and whether the session must now end.
+func (s *ftpSession) injectCommandFault(command string) (injected, closeSession bool) {
+	if !cfg.Chaos.Enabled {
+		return false, false
+	}
+	fault, ok := cfg.Chaos.Commands[command]
+	if !ok || len(fault.Codes) == 0 || rand.Float64() >= fault.Probability {
+		return false, false
+	}
+	code := fault.Codes[rand.Intn(len(fault.Codes))]
+	s.logFault("reply", map[string]any{"command": command, "code": code})
+	s.writeLine(faultReplies[code])
+	if code == 421 {
+		s.endReason = endFault
+		return true, true
+	}
+	return true, false
+}
+
+// dropTransfer decides whether the data transfer about to start will be cut off and,
+// if so, how many of its bytes get through.
+func (s *ftpSession) dropTransfer(size int) (int, bool) {
+	if !cfg.Chaos.Enabled || rand.Float64() >= cfg.Chaos.DropTransferProbability {
+		return size, false
+	}
+	sent := 0
+	if size > 0 {
+		sent = rand.Intn(size)
+	}
+	s.logFault("drop_transfer", map[string]any{"command": s.lastCommand, "sent": sent, "size": size})
+	return sent, true
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+//
+// Configuration
+//
+
+// defaultConfigPath is the configuration file read when no -config flag is given.
+const defaultConfigPath = "config.json"
+
+// Config holds the runtime settings loaded from the JSON configuration file.
+// Any field left out of the file keeps the value from defaultConfig.
+type Config struct {
+	// MetricsAddress is the HTTP address serving counters at /debug/vars; empty disables it.
+	MetricsAddress string       `json:"metricsAddress"`
+	Bounce         BounceConfig `json:"bounce"` // FTP bounce / FXP handling for PORT and EPRT.
+	Auth           AuthConfig   `json:"auth"`   // Which USER/PASS pairs are accepted.
+	// Users are the per-user profiles; "*" matches every user without a profile of their own.
+	Users []UserProfile `json:"users"`
+	// Trees are the file system layouts profiles can pick from, keyed by name.
+	// Entries replace the built-in layout of the same name.
+	Trees map[string]TreeSpec `json:"trees"`
+	// Seed makes tree generation reproducible across restarts; 0 picks a random seed.
+	Seed int64 `json:"seed"`
+	// Epoch is the time generated trees are dated up to; zero uses the start of the day
+	// they are generated on, which the snapshot records.
+	Epoch time.Time `json:"epoch"`
+	// PerIP gives every visitor network its own, stable trees.
+	PerIP PerIPConfig `json:"perIP"`
+	// Snapshot is the file the generated trees are saved to and reloaded from on
+	// restart, so they survive changes to the generators; empty disables it.
+	Snapshot string `json:"snapshot"`
+	// Anonymous controls classic anonymous FTP logins.
+	Anonymous AnonymousConfig `json:"anonymous"`
+	// Session limits how long and how much a single connection may be used.
+	Session SessionConfig `json:"session"`
+	// Connections caps concurrent control connections.
+	Connections ConnectionsConfig `json:"connections"`
+	// Tarpit slows down sessions classified as scanners or brute-forcers.
+	Tarpit TarpitConfig `json:"tarpit"`
+	// Persona is the built-in server persona: "nas", "seedbox", "dsl" or "windows".
+	Persona string `json:"persona"`
+	// Transfer shapes the throughput of LIST and RETR data connections.
+	Transfer TransferConfig `json:"transfer"`
+	// Latency delays every reply on the control connection.
+	Latency LatencyConfig `json:"latency"`
+	// Paths controls how path arguments are interpreted.
+	Paths PathsConfig `json:"paths"`
+	// Chaos injects faults to imitate a flaky server.
+	Chaos ChaosConfig `json:"chaos"`
+	// Access holds the CIDR allow, deny and ignore lists checked for every connection.
+	Access AccessConfig `json:"access"`
+	// Bans automatically bans IPs whose behavior matches a rule.
+	Bans BansConfig `json:"bans"`
+}
+
+// BounceConfig controls how PORT and EPRT targets other than the client are handled.
+type BounceConfig struct {
+	// Mode is either "refuse" (reply 500/504) or "fake" (reply 200 but never dial).
+	Mode string `json:"mode"`
+	// ScanThreshold is the number of distinct ports requested within ScanWindow
+	// after which the session is flagged as a bounce port scan.
+	ScanThreshold int `json:"scanThreshold"`
+	// ScanWindow is the sliding window used for port scan detection.
+	ScanWindow Duration `json:"scanWindow"`
+}
+
+// AuthConfig selects the login policy applied to PASS and how failures are answered.
+type AuthConfig struct {
+	// Policy is one of "any", "list", "reject-first", "probability" or "weak".
+	Policy string `json:"policy"`
+	// Accounts are the pairs accepted by the "list" policy; "*" matches anything.
+	Accounts []Account `json:"accounts"`
+	// RejectFirst is how many attempts per source IP the "reject-first" policy refuses.
+	RejectFirst int `json:"rejectFirst"`
+	// AcceptProbability is the chance, between 0 and 1, that "probability" accepts a login.
+	AcceptProbability float64 `json:"acceptProbability"`
+	// WeakPasswords are the passwords that unlock the "weak" policy.
+	WeakPasswords []string `json:"weakPasswords"`
+	// FailDelay is how long to wait before answering a failed login.
+	FailDelay Duration `json:"failDelay"`
+	// FailJitter is the maximum random time added to FailDelay.
+	FailJitter Duration `json:"failJitter"`
+}
+
+// UserProfile describes what a user sees after logging in.
+type UserProfile struct {
+	// Name is the login name the profile applies to, or "*" for everyone else.
+	Name string `json:"name"`
+	// Tree is the name of the file system template the user browses.
+	Tree string `json:"tree"`
+	// Chroot is the directory of the tree presented to the user as "/".
+	Chroot string `json:"chroot"`
+	// Home is the initial working directory, relative to Chroot.
+	Home string `json:"home"`
+	// Permissions are pyftpdlib-style letters: e (CWD), l (LIST), r (RETR), w (STOR).
+	Permissions string `json:"permissions"`
+	// DropBox is a directory, relative to Chroot, that accepts uploads even without
+	// the w permission but never lists them.
+	DropBox string `json:"dropBox"`
+	// Payload is the text served by RETR; PayloadFile, if set, is read instead.
+	Payload     string `json:"payload"`
+	PayloadFile string `json:"payloadFile"`
+}
+
+// AnonymousConfig controls anonymous logins, which use the "anonymous" user profile.
+type AnonymousConfig struct {
+	// Enabled turns on anonymous logins, which always succeed.
+	Enabled bool `json:"enabled"`
+	// Users are the login names treated as anonymous; their password is an email address.
+	Users []string `json:"users"`
+	// QuarantineDir is the local directory where uploads are stored.
+	QuarantineDir string `json:"quarantineDir"`
+	// MaxUploadSize is the largest upload, in bytes, that is kept.
+	MaxUploadSize int64 `json:"maxUploadSize"`
+}
+
+// SessionConfig limits individual sessions. A zero value disables a limit.
+type SessionConfig struct {
+	// IdleTimeout is how long the server waits for the next command.
+	IdleTimeout Duration `json:"idleTimeout"`
+	// MaxDuration is the longest a session may last in total.
+	MaxDuration Duration `json:"maxDuration"`
+	// MaxCommands is the most commands a session may send.
+	MaxCommands int `json:"maxCommands"`
+	// MaxLineLength is the longest command line that is processed; longer ones get a 500 reply.
+	MaxLineLength int `json:"maxLineLength"`
+	// MaxLineBytes is the hard limit for a single line; past it the connection is closed.
+	MaxLineBytes int `json:"maxLineBytes"`
+	// LineTimeout is how long a client may take to finish a line it has started.
+	LineTimeout Duration `json:"lineTimeout"`
+	// TrickleReads is how many network reads a line may take while averaging under
+	// two bytes each before it is treated as a trickle attack.
+	TrickleReads int `json:"trickleReads"`
+}
+
+// ConnectionsConfig caps concurrent control connections. A zero value disables a limit.
+type ConnectionsConfig struct {
+	// MaxTotal is the most connections served at once.
+	MaxTotal int `json:"maxTotal"`
+	// MaxPerIP is the most connections served at once for a single source IP.
+	MaxPerIP int `json:"maxPerIP"`
+}
+
+// TarpitConfig decides which sessions are tarpitted and how hard they are slowed down.
+// A zero rule value disables that rule.
+type TarpitConfig struct {
+	Enabled bool `json:"enabled"`
+	// FailedLogins tarpits a session after this many failed PASS attempts.
+	FailedLogins int `json:"failedLogins"`
+	// CommandsPerMinute tarpits a session that sends commands faster than this.
+	CommandsPerMinute int `json:"commandsPerMinute"`
+	// ClientPatterns tarpits a session whose command lines or CLNT contain one of
+	// these case-insensitive substrings.
+	ClientPatterns []string `json:"clientPatterns"`
+	// OnBounce tarpits sessions that attempt an FTP bounce.
+	OnBounce bool `json:"onBounce"`
+	// ReplyByteDelay is the pause after each byte of a reply line.
+	ReplyByteDelay Duration `json:"replyByteDelay"`
+	// FailDelayStep is added to the failed-login delay for every failure so far.
+	FailDelayStep Duration `json:"failDelayStep"`
+	// FailDelayMax caps the extra failed-login delay.
+	FailDelayMax Duration `json:"failDelayMax"`
+	// DataRate is the LIST/RETR throughput in bytes per second.
+	DataRate int `json:"dataRate"`
+}
+
+// TransferConfig selects the transfer-rate model for data connections.
+type TransferConfig struct {
+	// Mode is "none", "fixed" (Rate), "jitter" (Rate varied by Jitter) or "persona".
+	Mode string `json:"mode"`
+	// Rate is the throughput in bytes per second for the "fixed" and "jitter" modes.
+	Rate int `json:"rate"`
+	// Jitter is the fraction, between 0 and 1, by which "jitter" varies Rate.
+	Jitter float64 `json:"jitter"`
+}
+
+// LatencyConfig selects the delay applied before replying to each command.
+type LatencyConfig struct {
+	// Mode is "none", "fixed" (Delay plus up to Jitter) or "persona".
+	Mode   string   `json:"mode"`
+	Delay  Duration `json:"delay"`
+	Jitter Duration `json:"jitter"`
+}
+
+// ChaosConfig controls fault injection in the session loop.
+type ChaosConfig struct {
+	Enabled bool `json:"enabled"`
+	// Commands maps a command such as "RETR" to the failures it may be answered with.
+	Commands map[string]CommandFault `json:"commands"`
+	// DropTransferProbability is the chance that a LIST or RETR transfer is cut off midway.
+	DropTransferProbability float64 `json:"dropTransferProbability"`
+	// ResetAfterMin and ResetAfterMax bound the random number of commands after which
+	// the control connection is reset. Zero disables resets.
+	ResetAfterMin int `json:"resetAfterMin"`
+	ResetAfterMax int `json:"resetAfterMax"`
+}
+
+// CommandFault is the chance of failing a command and the reply codes to fail it with.
+type CommandFault struct {
+	Probability float64 `json:"probability"`
+	// Codes are chosen from at random: 421, 450, 451 or 452.
+	Codes []int `json:"codes"`
+}
+
+// PathsConfig controls how path arguments are interpreted.
+type PathsConfig struct {
+	// Backslashes makes "\" a path separator like "/", as on Windows servers.
+	Backslashes bool `json:"backslashes"`
+}
+
+// AccessConfig lists networks, in CIDR notation or as bare addresses, that get special treatment.
+type AccessConfig struct {
+	// Allow exempts networks from Deny.
+	Allow []string `json:"allow"`
+	// Deny closes connections from these networks immediately.
+	Deny []string `json:"deny"`
+	// Ignore serves these networks without logging anything, e.g. monitoring and researchers.
+	Ignore []string `json:"ignore"`
+	// ReloadInterval is how often the configuration file is checked for new lists.
+	ReloadInterval Duration `json:"reloadInterval"`
+}
+
+// BansConfig controls automatic banning.
+type BansConfig struct {
+	Enabled bool `json:"enabled"`
+	// File is where bans are stored so that they survive restarts.
+	File string `json:"file"`
+	// Rules are checked against every event; the first rule to reach its threshold bans the IP.
+	Rules []BanRule `json:"rules"`
+}
+
+// BanRule bans an IP for Duration once it causes Threshold matching events within Window.
+type BanRule struct {
+	// Event is an event type such as "bounce_attempt" or "dos_attempt", or "login_failure" for a failed PASS.
+	Event string `json:"event"`
+	// Kind optionally narrows the rule to events with that "kind" detail, e.g. "oversized_line".
+	Kind      string   `json:"kind"`
+	Threshold int      `json:"threshold"`
+	Window    Duration `json:"window"`
+	Duration  Duration `json:"duration"`
+}
+
+// TreeSpec describes a directory of a generated file system: its subdirectories,
+// fixed bait files, and the random files generated into it. Generator, Category,
+// Count, Size, Owner and Group are inherited by subdirectories that leave them unset.
+type TreeSpec struct {
+	// Name is the directory name; it is ignored for the root of a tree.
+	Name  string     `json:"name"`
+	Dirs  []TreeSpec `json:"dirs"`
+	Files []FileSpec `json:"files"`
+	// Generator names the random files: "files" (by Category), "porn" or "none".
+	Generator string `json:"generator"`
+	// Category is the kind of file names "files" produces: "documents", "pictures",
+	// "downloads", "applications", "game names", "backups" or "config".
+	Category string `json:"category"`
+	// Count is how many random files are generated.
+	Count *Range `json:"count"`
+	// Size is the range of random file sizes; unset picks from a fixed set of sizes.
+	Size *Range `json:"size"`
+	// Owner and Group own the directory and its files; "ftp" by default.
+	Owner string `json:"owner"`
+	Group string `json:"group"`
+}
+
+// PerIPConfig controls per-visitor trees.
+type PerIPConfig struct {
+	Enabled bool `json:"enabled"`
+	// Key is the secret the trees are derived from; empty uses the seed of the default tree.
+	Key string `json:"key"`
+	// IPv4Prefix and IPv6Prefix are the prefix lengths of the networks sharing a tree.
+	IPv4Prefix int `json:"ipv4Prefix"`
+	IPv6Prefix int `json:"ipv6Prefix"`
+	// CacheSize is the number of generated trees kept in memory.
+	CacheSize int `json:"cacheSize"`
+}
+
+// FileSpec is a fixed file placed in a generated tree. Names starting with a dot are hidden.
+type FileSpec struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Target makes the file a symbolic link to that path, relative to the
+	// link's directory or, when absolute, to the root of the tree.
+	Target string `json:"target"`
+}
+
+// Range is an inclusive range of integers.
+type Range struct {
+	Min int64 `json:"min"`
+	Max int64 `json:"max"`
+}
+
+// Account is a username and password pair.
+type Account struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// Duration is a time.Duration that is written as a string such as "90s" in JSON.
+type Duration time.Duration
+
+// MarshalJSON encodes the duration in time.Duration string form.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON accepts either a duration string ("1m30s") or a number of seconds.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		parsed, err := time.ParseDuration(str)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+		return nil
+	}
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err != nil {
+		return fmt.Errorf("invalid duration %s", string(data))
+	}
+	*d = Duration(seconds * float64(time.Second))
+	return nil
+}
+
+// defaultConfig returns the settings used when no configuration file is present. The
+// users and ban rules are filled in by fillDefaultLists.
+func defaultConfig() *Config {
+	return &Config{
+		Bounce: BounceConfig{
+			Mode:          "refuse",
+			ScanThreshold: 5,
+			ScanWindow:    Duration(time.Minute),
+		},
+		Auth: AuthConfig{
+			Policy:            "any",
+			RejectFirst:       3,
+			AcceptProbability: 0.25,
+			WeakPasswords: []string{
+				"123456", "password", "12345678", "qwerty", "admin",
+				"1234", "12345", "root", "ftp", "test",
+			},
+			FailDelay:  Duration(time.Second),
+			FailJitter: Duration(2 * time.Second),
+		},
+		Anonymous: AnonymousConfig{
+			Enabled:       true,
+			Users:         []string{"anonymous", "ftp"},
+			QuarantineDir: "quarantine",
+			MaxUploadSize: 10 << 20,
+		},
+		Session: SessionConfig{
+			IdleTimeout:   Duration(5 * time.Minute),
+			MaxDuration:   Duration(time.Hour),
+			MaxCommands:   1000,
+			MaxLineLength: maxCommandLineLength,
+			MaxLineBytes:  64 << 10,
+			LineTimeout:   Duration(30 * time.Second),
+			TrickleReads:  64,
+		},
+		Connections: ConnectionsConfig{
+			MaxTotal: 200,
+			MaxPerIP: 10,
+		},
+		Tarpit: TarpitConfig{
+			Enabled:           false,
+			FailedLogins:      5,
+			CommandsPerMinute: 120,
+			ClientPatterns:    []string{"nmap", "masscan", "zgrab", "hydra", "medusa"},
+			OnBounce:          true,
+			ReplyByteDelay:    Duration(250 * time.Millisecond),
+			FailDelayStep:     Duration(2 * time.Second),
+			FailDelayMax:      Duration(30 * time.Second),
+			DataRate:          4,
+		},
+		Persona: "nas",
+		Transfer: TransferConfig{
+			Mode:   "persona",
+			Rate:   1 << 20,
+			Jitter: 0.3,
+		},
+		Latency: LatencyConfig{
+			Mode:   "persona",
+			Delay:  Duration(50 * time.Millisecond),
+			Jitter: Duration(50 * time.Millisecond),
+		},
+		Access: AccessConfig{
+			ReloadInterval: Duration(30 * time.Second),
+		},
+		Trees:    defaultTrees(),
+		Snapshot: "filesystem.json",
+		PerIP: PerIPConfig{
+			IPv4Prefix: 24,
+			IPv6Prefix: 64,
+			CacheSize:  256,
+		},
+		Bans: BansConfig{
+			File: "bans.json",
+		},
+	}
+}
+
+// defaultUserProfiles returns the profiles used when the configuration has no users.
+func defaultUserProfiles() []UserProfile {
+	return []UserProfile{
+		{Name: "anonymous", Tree: "public", Home: "/", Permissions: "elr", DropBox: "/incoming"},
+		{Name: "admin", Tree: "admin", Home: "/", Permissions: "elr"},
+		{Name: "backup", Tree: "backup", Home: "/daily", Permissions: "elr"},
+		{Name: "*", Tree: "default", Home: "/", Permissions: "elr"},
+	}
+}
+
+// defaultBanRules returns the ban rules used when the configuration has none.
+func defaultBanRules() []BanRule {
+	return []BanRule{
+		{Event: "login_failure", Threshold: 50, Window: Duration(5 * time.Minute), Duration: Duration(24 * time.Hour)},
+		{Event: "bounce_attempt", Threshold: 1, Duration: Duration(7 * 24 * time.Hour)},
+		{Event: "dos_attempt", Threshold: 1, Duration: Duration(24 * time.Hour)},
+	}
+}
+
+// fillDefaultLists sets the lists of structs the configuration file left out to their
+// defaults. They can't be part of defaultConfig, because json.Unmarshal decodes a list
+// into the existing elements, so a configured entry would inherit the settings of the
+// built-in entry at the same index.
+func (c *Config) fillDefaultLists() {
+	if c.Users == nil {
+		c.Users = defaultUserProfiles()
+	}
+	if c.Bans.Rules == nil {
+		c.Bans.Rules = defaultBanRules()
+	}
+}
+
+// isFlagSet reports whether the named flag was given on the command line.
+func isFlagSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// loadConfig reads the configuration file at configPath on top of the defaults.
+// A missing file is not an error unless it was explicitly requested.
+func loadConfig(configPath string, required bool) (*Config, error) {
+	config := defaultConfig()
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) && !required {
+			config.fillDefaultLists()
+			return config, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", configPath, err)
+	}
+	config.fillDefaultLists()
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", configPath, err)
+	}
+	for name, tree := range personas[config.Persona].Trees {
+		config.Trees[name] = config.Trees[tree]
+	}
+	return config, nil
+}
+
+// foldsCase reports whether the configured persona treats names that differ only in
+// case as the same name.
+func (c *Config) foldsCase() bool {
+	return personas[c.Persona].Windows
+}
+
+// validate checks the configuration for values the server cannot work with.
+func (c *Config) validate() error {
+	switch c.Bounce.Mode {
+	case "refuse", "fake":
+	default:
+		return fmt.Errorf("bounce.mode must be \"refuse\" or \"fake\", got %q", c.Bounce.Mode)
+	}
+	switch c.Auth.Policy {
+	case "any", "list", "reject-first", "probability", "weak":
+	default:
+		return fmt.Errorf("unknown auth.policy %q", c.Auth.Policy)
+	}
+	if c.Auth.AcceptProbability < 0 || c.Auth.AcceptProbability > 1 {
+		return fmt.Errorf("auth.acceptProbability must be between 0 and 1")
+	}
+	if _, ok := personas[c.Persona]; !ok {
+		return fmt.Errorf("unknown persona %q", c.Persona)
+	}
+	for _, tree := range personas[c.Persona].Trees {
+		if _, ok := c.Trees[tree]; !ok {
+			return fmt.Errorf("persona %q needs a %q tree", c.Persona, tree)
+		}
+	}
+	switch c.Transfer.Mode {
+	case "none", "fixed", "jitter", "persona":
+	default:
+		return fmt.Errorf("unknown transfer.mode %q", c.Transfer.Mode)
+	}
+	if (c.Transfer.Mode == "fixed" || c.Transfer.Mode == "jitter") && c.Transfer.Rate <= 0 {
+		return fmt.Errorf("transfer.rate must be positive in %q mode", c.Transfer.Mode)
+	}
+	if c.Transfer.Jitter < 0 || c.Transfer.Jitter > 1 {
+		return fmt.Errorf("transfer.jitter must be between 0 and 1")
+	}
+	switch c.Latency.Mode {
+	case "none", "fixed", "persona":
+	default:
+		return fmt.Errorf("unknown latency.mode %q", c.Latency.Mode)
+	}
+	for command, fault := range c.Chaos.Commands {
+		if command != strings.ToUpper(command) {
+			return fmt.Errorf("chaos.commands: command %q must be upper case", command)
+		}
+		for _, code := range fault.Codes {
+			if _, ok := faultReplies[code]; !ok {
+				return fmt.Errorf("chaos.commands.%s: unsupported reply code %d", command, code)
+			}
+		}
+	}
+	if _, err := newAccessLists(c.Access); err != nil {
+		return err
+	}
+	for name, tree := range c.Trees {
+		if err := tree.validate(c.foldsCase()); err != nil {
+			return fmt.Errorf("trees.%s: %w", name, err)
+		}
+	}
+	if _, ok := c.Trees["default"]; !ok {
+		return fmt.Errorf("trees: a default tree is required")
+	}
+	if _, ok := c.Trees["public"]; !ok && c.Anonymous.Enabled {
+		return fmt.Errorf("trees: anonymous FTP needs a public tree")
+	}
+	if c.PerIP.IPv4Prefix < 0 || c.PerIP.IPv4Prefix > 32 || c.PerIP.IPv6Prefix < 0 || c.PerIP.IPv6Prefix > 128 {
+		return fmt.Errorf("perIP: prefix lengths must be 0-32 for IPv4 and 0-128 for IPv6")
+	}
+	if c.PerIP.Enabled && c.PerIP.CacheSize < 1 {
+		return fmt.Errorf("perIP.cacheSize must be positive")
+	}
+	if c.Bans.Enabled && c.Bans.File == "" {
+		return fmt.Errorf("bans.file must be set when bans are enabled")
+	}
+	for i, rule := range c.Bans.Rules {
+		if rule.Event == "" || rule.Threshold < 1 || rule.Duration <= 0 || (rule.Threshold > 1 && rule.Window <= 0) {
+			return fmt.Errorf("bans.rules[%d]: needs an event, a positive threshold and duration, and a window for thresholds above 1", i)
+		}
+	}
+	if c.Session.MaxLineLength <= 0 {
+		return fmt.Errorf("session.maxLineLength must be positive")
+	}
+	for _, user := range c.Users {
+		if user.Name == "" {
+			return fmt.Errorf("users: every profile needs a name")
+		}
+		if strings.Trim(user.Permissions, "elrw") != "" {
+			return fmt.Errorf("user %q: unknown permissions in %q", user.Name, user.Permissions)
+		}
+		if _, ok := c.Trees[user.Tree]; !ok {
+			return fmt.Errorf("user %q: unknown tree %q", user.Name, user.Tree)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Credential Logging
+//
+
+// maxFingerprintCommands caps how many pre-login commands are kept for the client fingerprint.
+const maxFingerprintCommands = 16
+
+// CredentialLog represents a single USER/PASS attempt.
+type CredentialLog struct {
+	Timestamp string `json:"timestamp"`
+	IP        string `json:"ip"`
+	Session   string `json:"session"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	Result    string `json:"result"`
+	Client    string `json:"client,omitempty"`
+	TLS       bool   `json:"tls"`
+}
+
+var (
+	// credLogFile is the file where credential logs are stored.
+	credLogFile *os.File
+	// credMutex protects access to credLogFile.
+	credMutex sync.Mutex
+)
+
+// initCredentialLogger initializes the credential logger by opening (or creating) the log file.
+func initCredentialLogger() {
+	var err error
+	credLogFile, err = os.OpenFile("credentials.jsonl", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalf("Error opening credential log file: %v", err)
+	}
+}
+
+// logCredential writes a credential log entry in JSON lines format.
+func (s *ftpSession) logCredential(password, result string) {
+	if s.quiet {
+		return
+	}
+	_, isTLS := s.conn.(*tls.Conn)
+	entry := CredentialLog{
+		Timestamp: time.Now().Format(time.RFC3339),
+		IP:        s.conn.RemoteAddr().String(),
+		Session:   s.id,
+		Username:  s.user,
+		Password:  password,
+		Result:    result,
+		Client:    s.clientFingerprint(),
+		TLS:       isTLS,
+	}
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error marshaling credential log: %v", err)
+		return
+	}
+	credMutex.Lock()
+	defer credMutex.Unlock()
+	credLogFile.WriteString(string(entryJSON) + "\n")
+}
+
+// recordPreLoginCommand remembers the commands a client sends before logging in.
+// Different FTP clients and bots open with distinctive sequences (FEAT, SYST, CLNT, ...).
+func (s *ftpSession) recordPreLoginCommand(command string) {
+	if s.state != stateLoggedIn && len(s.preLoginCommands) < maxFingerprintCommands {
+		s.preLoginCommands = append(s.preLoginCommands, command)
+	}
+}
+
+// clientFingerprint describes the client from its CLNT announcement and the
+// commands it sent before logging in, e.g. "clnt=FileZilla;seq=USER,PASS".
+func (s *ftpSession) clientFingerprint() string {
+	fingerprint := "seq=" + strings.Join(s.preLoginCommands, ",")
+	if s.clientName != "" {
+		fingerprint = "clnt=" + s.clientName + ";" + fingerprint
+	}
+	return fingerprint
+}
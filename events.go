@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//
+// Event Logging
+//
+
+// Event severities, from routine to worth-a-look.
+const (
+	severityInfo   = "info"
+	severityMedium = "medium"
+	severityHigh   = "high"
+)
+
+// EventLog represents a single security-relevant event, such as a bounce attempt.
+type EventLog struct {
+	Timestamp string         `json:"timestamp"`
+	IP        string         `json:"ip"`
+	Session   string         `json:"session,omitempty"`
+	Event     string         `json:"event"`
+	Severity  string         `json:"severity"`
+	Details   map[string]any `json:"details,omitempty"`
+}
+
+var (
+	// eventLogFile is the file where event logs are stored.
+	eventLogFile *os.File
+	// eventMutex protects access to eventLogFile.
+	eventMutex sync.Mutex
+)
+
+// initEventLogger initializes the event logger by opening (or creating) the log file.
+func initEventLogger() {
+	var err error
+	eventLogFile, err = os.OpenFile("events.jsonl", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalf("Error opening event log file: %v", err)
+	}
+}
+
+// logEvent writes an event log entry in JSON lines format.
+func logEvent(ip, session, event, severity string, details map[string]any) {
+	entry := EventLog{
+		Timestamp: time.Now().Format(time.RFC3339),
+		IP:        ip,
+		Session:   session,
+		Event:     event,
+		Severity:  severity,
+		Details:   details,
+	}
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error marshaling event log: %v", err)
+		return
+	}
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+	eventLogFile.WriteString(string(entryJSON) + "\n")
+}
+
+// newSessionID returns a short random identifier used to correlate a session's log entries.
+func newSessionID() string {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(buf[:])
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// File System Import
+//
+
+var (
+	// unixEntryRegexp matches an ls -l line with the classic "Mon dd HH:MM" or "Mon dd  YYYY" date.
+	unixEntryRegexp = regexp.MustCompile(`^([-dlpsbc])([-rwxsStT]{9})[.+@]?\s+(\d+)\s+(\S+)\s+(\S+)\s+(\d+)\s+([A-Z][a-z]{2})\s+(\d{1,2})\s+(\d{1,2}:\d{2}|\d{4})\s(.+)$`)
+	// unixISOEntryRegexp matches an ls -l line with a --time-style=long-iso or full-iso date.
+	unixISOEntryRegexp = regexp.MustCompile(`^([-dlpsbc])([-rwxsStT]{9})[.+@]?\s+(\d+)\s+(\S+)\s+(\S+)\s+(\d+)\s+(\d{4}-\d{2}-\d{2})\s+(\d{2}:\d{2})(?::[\d.]+)?(?:\s+[-+]\d{4})?\s(.+)$`)
+	// windowsEntryRegexp matches a line of cmd.exe "dir" or IIS FTP DOS-style listings.
+	windowsEntryRegexp = regexp.MustCompile(`^(\d{2})[-/](\d{2})[-/](\d{2}|\d{4})\s+(\d{1,2}):(\d{2})\s*([AaPp][Mm])?\s+(<DIR>|[\d,.]+)\s+(.+)$`)
+	// windowsHeaderRegexp matches the " Directory of C:\path" header of dir /s.
+	windowsHeaderRegexp = regexp.MustCompile(`^\s*Directory of (.+)$`)
+)
+
+// importTree builds a tree from the file at name, which is a tar (optionally gzipped) or
+// zip archive, or an ls -lR or dir /s listing. format is "tar", "zip", "ls" or "auto".
+// The file is streamed, so that large archives are never read into memory as a whole.
+func importTree(name, format string) (*FSNode, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	input := bufio.NewReader(file)
+	if format == "auto" {
+		header, _ := input.Peek(262)
+		format = detectImportFormat(header)
+	}
+	var root *FSNode
+	switch format {
+	case "tar":
+		root, err = importTar(input)
+	case "zip":
+		root, err = importZip(name)
+	case "ls":
+		root, err = importListing(input)
+	default:
+		return nil, fmt.Errorf("unknown import format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	root.settleDirs()
+	return root, nil
+}
+
+// detectImportFormat guesses the format of a file from the magic numbers in data, its
+// first bytes.
+func detectImportFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")), bytes.HasPrefix(data, []byte("PK\x05\x06")):
+		return "zip"
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return "tar"
+	case len(data) >= 262 && string(data[257:262]) == "ustar":
+		return "tar"
+	default:
+		return "ls"
+	}
+}
+
+// importDir returns the directory at dirPath below root, creating it and its parents as needed.
+func importDir(root *FSNode, dirPath string) *FSNode {
+	node := root
+	for _, part := range strings.Split(dirPath, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		child := node.FindChild(part)
+		if child == nil || !child.IsDir {
+			if child != nil {
+				node.removeChild(part)
+			}
+			child = &FSNode{Name: part, IsDir: true}
+			node.Children = append(node.Children, child)
+		}
+		node = child
+	}
+	return node
+}
+
+// importEntry adds entry to the directory at dirPath below root. A directory entry
+// only sets the metadata of the directory, whose contents may already be known.
+func importEntry(root *FSNode, dirPath string, entry *FSNode) {
+	if entry.Name == "" || entry.Name == "." || entry.Name == ".." || strings.Contains(entry.Name, "/") {
+		return
+	}
+	parent := importDir(root, dirPath)
+	if entry.IsDir {
+		dir := importDir(parent, entry.Name)
+		dir.Size, dir.ModTime, dir.Mode, dir.Owner, dir.Group, dir.Links = entry.Size, entry.ModTime, entry.Mode, entry.Owner, entry.Group, entry.Links
+		return
+	}
+	parent.removeChild(entry.Name)
+	parent.Children = append(parent.Children, entry)
+}
+
+// settleDirs fills in what an import leaves unset for node and the directories below it,
+// such as directories only implied by the paths of their entries: each directory is at
+// least as new as its newest entry, and takes the usual 4096 bytes.
+func (node *FSNode) settleDirs() {
+	for _, child := range node.Children {
+		if child.IsDir {
+			child.settleDirs()
+		}
+		if child.ModTime.After(node.ModTime) {
+			node.ModTime = child.ModTime
+		}
+	}
+	if node.Size == 0 {
+		node.Size = 4096
+	}
+}
+
+// removeChild removes the child with the given name, if there is one.
+func (node *FSNode) removeChild(childName string) {
+	for i, child := range node.Children {
+		if child.Name == childName {
+			node.Children = append(node.Children[:i], node.Children[i+1:]...)
+			return
+		}
+	}
+}
+
+// importTar builds a tree from the headers of a tar archive, which may be gzipped.
+func importTar(input *bufio.Reader) (*FSNode, error) {
+	var reader io.Reader = input
+	if magic, _ := input.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(input)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	root := &FSNode{Name: "/", IsDir: true}
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean("/" + header.Name)
+		if name == "/" {
+			continue
+		}
+		entry := &FSNode{
+			Name:    path.Base(name),
+			IsDir:   header.Typeflag == tar.TypeDir,
+			Size:    header.Size,
+			ModTime: header.ModTime.UTC(),
+			Mode:    fs.FileMode(header.Mode).Perm(),
+			Owner:   header.Uname,
+			Group:   header.Gname,
+		}
+		if header.Typeflag == tar.TypeSymlink {
+			entry.Target = header.Linkname
+		}
+		if entry.Owner == "" {
+			entry.Owner = strconv.Itoa(header.Uid)
+		}
+		if entry.Group == "" {
+			entry.Group = strconv.Itoa(header.Gid)
+		}
+		importEntry(root, path.Dir(name), entry)
+	}
+	return root, nil
+}
+
+// importZip builds a tree from the central directory of a zip archive.
+// Zip archives carry no owners, so those are left to the listing defaults.
+func importZip(name string) (*FSNode, error) {
+	archive, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	root := &FSNode{Name: "/", IsDir: true}
+	for _, file := range archive.File {
+		name := path.Clean("/" + file.Name)
+		if name == "/" {
+			continue
+		}
+		entry := &FSNode{
+			Name:    path.Base(name),
+			IsDir:   strings.HasSuffix(file.Name, "/") || file.Mode().IsDir(),
+			Size:    int64(file.UncompressedSize64),
+			ModTime: file.Modified.UTC(),
+			Mode:    file.Mode().Perm(),
+		}
+		importEntry(root, path.Dir(name), entry)
+	}
+	return root, nil
+}
+
+// importListing builds a tree from a Unix ls -lR or a Windows dir /s listing. The first
+// directory header names the root; entries before any header belong to the root too.
+func importListing(input io.Reader) (*FSNode, error) {
+	root := &FSNode{Name: "/", IsDir: true}
+	baseDir, currentDir := "", ""
+	headerAllowed := true
+	entries := 0
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			headerAllowed = true
+			continue
+		}
+		if match := windowsHeaderRegexp.FindStringSubmatch(line); match != nil {
+			baseDir, currentDir = listingDir(strings.ReplaceAll(strings.TrimSpace(match[1]), `\`, "/"), baseDir)
+			continue
+		}
+		if entry := parseListingEntry(line); entry != nil {
+			importEntry(root, currentDir, entry)
+			entries++
+			headerAllowed = false
+			continue
+		}
+		if headerAllowed && strings.HasSuffix(trimmed, ":") && !strings.HasPrefix(trimmed, "total ") {
+			baseDir, currentDir = listingDir(strings.TrimSuffix(trimmed, ":"), baseDir)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if entries == 0 {
+		return nil, errors.New("no ls -l or dir entries found")
+	}
+	return root, nil
+}
+
+// listingDir returns the base directory and the directory relative to it for a listing
+// header naming dir. The first header seen becomes the base directory.
+func listingDir(dir, baseDir string) (string, string) {
+	dir = strings.TrimSuffix(dir, "/")
+	if baseDir == "" {
+		return dir, ""
+	}
+	if rel, ok := strings.CutPrefix(dir, baseDir+"/"); ok {
+		return baseDir, rel
+	}
+	if dir == baseDir {
+		return baseDir, ""
+	}
+	return baseDir, strings.TrimPrefix(dir, "./")
+}
+
+// parseListingEntry parses a single Unix or Windows listing line, or returns nil if it is not one.
+func parseListingEntry(line string) *FSNode {
+	if match := unixEntryRegexp.FindStringSubmatch(line); match != nil {
+		modTime, err := parseUnixListingTime(match[7], match[8], match[9])
+		if err != nil {
+			return nil
+		}
+		return unixListingEntry(match[1:7], match[10], modTime)
+	}
+	if match := unixISOEntryRegexp.FindStringSubmatch(line); match != nil {
+		modTime, err := time.Parse("2006-01-02 15:04", match[7]+" "+match[8])
+		if err != nil {
+			return nil
+		}
+		return unixListingEntry(match[1:7], match[9], modTime)
+	}
+	if match := windowsEntryRegexp.FindStringSubmatch(line); match != nil {
+		return windowsListingEntry(match)
+	}
+	return nil
+}
+
+// unixListingEntry builds a node from the type, permissions, link count, owner, group
+// and size columns of an ls -l line.
+func unixListingEntry(columns []string, name string, modTime time.Time) *FSNode {
+	kind, perms := columns[0], columns[1]
+	links, _ := strconv.Atoi(columns[2])
+	size, _ := strconv.ParseInt(columns[5], 10, 64)
+	var target string
+	if kind == "l" {
+		name, target, _ = strings.Cut(name, " -> ")
+	}
+	return &FSNode{
+		Name:    name,
+		IsDir:   kind == "d",
+		Size:    size,
+		ModTime: modTime,
+		Mode:    parsePermissions(perms),
+		Owner:   columns[3],
+		Group:   columns[4],
+		Links:   links,
+		Target:  target,
+	}
+}
+
+// parseUnixListingTime parses the date columns of ls -l. Recent entries show a time
+// instead of a year; they are placed in the last twelve months.
+func parseUnixListingTime(month, day, timeOrYear string) (time.Time, error) {
+	if strings.Contains(timeOrYear, ":") {
+		now := time.Now().UTC()
+		modTime, err := time.Parse("Jan 2 15:04 2006", fmt.Sprintf("%s %s %s %d", month, day, timeOrYear, now.Year()))
+		if err == nil && modTime.After(now.AddDate(0, 0, 1)) {
+			modTime = modTime.AddDate(-1, 0, 0)
+		}
+		return modTime, err
+	}
+	return time.Parse("Jan 2 2006", fmt.Sprintf("%s %s %s", month, day, timeOrYear))
+}
+
+// parsePermissions converts the nine rwx characters of ls -l to permission bits.
+// The setuid, setgid and sticky letters count as execute permission.
+func parsePermissions(perms string) fs.FileMode {
+	var mode fs.FileMode
+	for i := 0; i < 9; i++ {
+		if perms[i] != '-' && perms[i] != 'S' && perms[i] != 'T' {
+			mode |= 1 << (8 - i)
+		}
+	}
+	return mode
+}
+
+// windowsListingEntry builds a node from the submatches of windowsEntryRegexp.
+func windowsListingEntry(match []string) *FSNode {
+	month, _ := strconv.Atoi(match[1])
+	day, _ := strconv.Atoi(match[2])
+	year, _ := strconv.Atoi(match[3])
+	if len(match[3]) == 2 {
+		// DOS-style two-digit years pivot like IIS does.
+		if year < 70 {
+			year += 2000
+		} else {
+			year += 1900
+		}
+	}
+	hour, _ := strconv.Atoi(match[4])
+	minute, _ := strconv.Atoi(match[5])
+	switch strings.ToUpper(match[6]) {
+	case "PM":
+		if hour < 12 {
+			hour += 12
+		}
+	case "AM":
+		if hour == 12 {
+			hour = 0
+		}
+	}
+	entry := &FSNode{
+		Name:    match[8],
+		IsDir:   match[7] == "<DIR>",
+		ModTime: time.Date(year, time.Month(month), day, hour, minute, 0, 0, time.UTC),
+	}
+	if !entry.IsDir {
+		entry.Size, _ = strconv.ParseInt(strings.NewReplacer(",", "", ".", "").Replace(match[7]), 10, 64)
+	}
+	return entry
+}
+
+// runImportFS implements the "import-fs" subcommand, which builds a tree from a listing
+// or archive and stores it in the snapshot file in place of the generated one.
+func runImportFS(args []string) error {
+	flags := flag.NewFlagSet("import-fs", flag.ExitOnError)
+	configPath := flags.String("config", defaultConfigPath, "path to the JSON configuration file")
+	treeName := flags.String("tree", "default", "name of the tree to replace")
+	format := flags.String("format", "auto", "input format: auto, ls, tar or zip")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: lovecraft-ftp import-fs [-config config.json] [-tree default] [-format auto|ls|tar|zip] <file>")
+	}
+	config, err := loadConfig(*configPath, isFlagSet(flags, "config"))
+	if err != nil {
+		return err
+	}
+	if config.Snapshot == "" {
+		return errors.New("snapshots are disabled; set \"snapshot\" in the configuration")
+	}
+	spec, ok := config.Trees[*treeName]
+	if !ok {
+		return fmt.Errorf("unknown tree %q", *treeName)
+	}
+	root, err := importTree(flags.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+	if err := root.validate("/", config.foldsCase()); err != nil {
+		return fmt.Errorf("%s: %w", flags.Arg(0), err)
+	}
+
+	snapshot, _, err := generateTrees(config)
+	if err != nil {
+		return err
+	}
+	snapshot.Trees[*treeName] = &snapshotTree{Spec: spec, Source: flags.Arg(0), Root: root}
+	if err := snapshot.write(config.Snapshot); err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d entries from %s as the %q tree in %s; restart the server to serve it\n",
+		root.count()-1, flags.Arg(0), *treeName, config.Snapshot)
+	return nil
+}
+
+// count returns the number of nodes in the tree rooted at node, node included.
+func (node *FSNode) count() int {
+	n := 1
+	for _, child := range node.Children {
+		n += child.count()
+	}
+	return n
+}
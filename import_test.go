@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseListingEntry(t *testing.T) {
+	for _, test := range []struct {
+		line string
+		want *FSNode
+	}{
+		{
+			"-rw-r--r--    1 alice    staff        1234 Mar  3  2021 notes.txt",
+			&FSNode{Name: "notes.txt", Size: 1234, ModTime: time.Date(2021, 3, 3, 0, 0, 0, 0, time.UTC), Mode: 0644, Owner: "alice", Group: "staff", Links: 1},
+		},
+		{
+			"drwxr-x---.   5 root root 4096 Dec 31  1999 old dir",
+			&FSNode{Name: "old dir", IsDir: true, Size: 4096, ModTime: time.Date(1999, 12, 31, 0, 0, 0, 0, time.UTC), Mode: 0750, Owner: "root", Group: "root", Links: 5},
+		},
+		{
+			"-rwsr-xr-T 1 root root 10 2022-05-06 07:08 setuid",
+			&FSNode{Name: "setuid", Size: 10, ModTime: time.Date(2022, 5, 6, 7, 8, 0, 0, time.UTC), Mode: 0754, Owner: "root", Group: "root", Links: 1},
+		},
+		{
+			"-rw-r--r-- 1 bob bob 7 2023-01-02 03:04:05.123456789 +0100 full-iso.log",
+			&FSNode{Name: "full-iso.log", Size: 7, ModTime: time.Date(2023, 1, 2, 3, 4, 0, 0, time.UTC), Mode: 0644, Owner: "bob", Group: "bob", Links: 1},
+		},
+		{
+			"lrwxrwxrwx 1 root root 11 Jan  5  2020 latest -> backups/2024",
+			&FSNode{Name: "latest", Size: 11, ModTime: time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC), Mode: 0777, Owner: "root", Group: "root", Links: 1, Target: "backups/2024"},
+		},
+		{
+			"lrwxrwxrwx 1 root root 4 2020-01-05 10:00 a -> b -> c",
+			&FSNode{Name: "a", Size: 4, ModTime: time.Date(2020, 1, 5, 10, 0, 0, 0, time.UTC), Mode: 0777, Owner: "root", Group: "root", Links: 1, Target: "b -> c"},
+		},
+		{
+			"01-15-24  03:12PM       <DIR>          backups",
+			&FSNode{Name: "backups", IsDir: true, ModTime: time.Date(2024, 1, 15, 15, 12, 0, 0, time.UTC)},
+		},
+		{
+			"07-04-99  12:00AM                 1024 midnight.txt",
+			&FSNode{Name: "midnight.txt", Size: 1024, ModTime: time.Date(1999, 7, 4, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			"07-04-69  12:30PM                  512 noon.txt",
+			&FSNode{Name: "noon.txt", Size: 512, ModTime: time.Date(2069, 7, 4, 12, 30, 0, 0, time.UTC)},
+		},
+		{
+			"03/09/2023  11:47 PM         1,048,576 Program Files.zip",
+			&FSNode{Name: "Program Files.zip", Size: 1048576, ModTime: time.Date(2023, 3, 9, 23, 47, 0, 0, time.UTC)},
+		},
+		{
+			"03.09.2023  23:47    <DIR>          x",
+			nil,
+		},
+		{"total 48", nil},
+		{" Volume in drive C has no label.", nil},
+		{"./a/b:", nil},
+	} {
+		got := parseListingEntry(test.line)
+		switch {
+		case got == nil && test.want == nil:
+		case got == nil || test.want == nil:
+			t.Errorf("parseListingEntry(%q) = %+v; want %+v", test.line, got, test.want)
+		case got.Name != test.want.Name || got.IsDir != test.want.IsDir || got.Size != test.want.Size ||
+			!got.ModTime.Equal(test.want.ModTime) || got.Mode != test.want.Mode || got.Owner != test.want.Owner ||
+			got.Group != test.want.Group || got.Links != test.want.Links || got.Target != test.want.Target:
+			t.Errorf("parseListingEntry(%q) = %+v; want %+v", test.line, *got, *test.want)
+		}
+	}
+}
+
+func TestParseUnixListingTime(t *testing.T) {
+	now := time.Now().UTC()
+	recent := now.AddDate(0, 0, -2)
+	upcoming := now.AddDate(0, 0, 40)
+	for _, test := range []struct {
+		month, day, timeOrYear string
+		want                   time.Time
+	}{
+		{"Mar", "3", "2021", time.Date(2021, 3, 3, 0, 0, 0, 0, time.UTC)},
+		{"Feb", "29", "2024", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// A time instead of a year means the last twelve months: this year unless that
+		// would be in the future, in which case it was last year.
+		{recent.Format("Jan"), recent.Format("2"), "13:37",
+			time.Date(recent.Year(), recent.Month(), recent.Day(), 13, 37, 0, 0, time.UTC)},
+		{upcoming.Format("Jan"), upcoming.Format("2"), "08:15",
+			time.Date(upcoming.Year()-1, upcoming.Month(), upcoming.Day(), 8, 15, 0, 0, time.UTC)},
+	} {
+		got, err := parseUnixListingTime(test.month, test.day, test.timeOrYear)
+		if err != nil || !got.Equal(test.want) {
+			t.Errorf("parseUnixListingTime(%q, %q, %q) = %v, %v; want %v", test.month, test.day, test.timeOrYear, got, err, test.want)
+		}
+	}
+	if _, err := parseUnixListingTime("Foo", "1", "2020"); err == nil {
+		t.Errorf("parseUnixListingTime accepted month %q", "Foo")
+	}
+}
+
+func TestParsePermissions(t *testing.T) {
+	for _, test := range []struct {
+		perms string
+		want  fs.FileMode
+	}{
+		{"rwxr-xr-x", 0755},
+		{"rw-------", 0600},
+		{"---------", 0},
+		{"rwsr-sr-t", 0755},
+		{"rwSr-Sr-T", 0644},
+	} {
+		if got := parsePermissions(test.perms); got != test.want {
+			t.Errorf("parsePermissions(%q) = %o; want %o", test.perms, got, test.want)
+		}
+	}
+}
+
+func TestListingDir(t *testing.T) {
+	for _, test := range []struct {
+		dir, baseDir string
+		wantBase     string
+		wantRel      string
+	}{
+		{".", "", ".", ""},
+		{"/srv/ftp/", "", "/srv/ftp", ""},
+		{"./a/b", ".", ".", "a/b"},
+		{"./a", ".", ".", "a"},
+		{"/srv/ftp/pub/docs", "/srv/ftp", "/srv/ftp", "pub/docs"},
+		{"/srv/ftp", "/srv/ftp", "/srv/ftp", ""},
+		{"C:/inetpub/ftproot/Users", "C:/inetpub/ftproot", "C:/inetpub/ftproot", "Users"},
+		{"elsewhere/x", "/srv/ftp", "/srv/ftp", "elsewhere/x"},
+	} {
+		base, rel := listingDir(test.dir, test.baseDir)
+		if base != test.wantBase || rel != test.wantRel {
+			t.Errorf("listingDir(%q, %q) = %q, %q; want %q, %q", test.dir, test.baseDir, base, rel, test.wantBase, test.wantRel)
+		}
+	}
+}
+
+func TestImportListing(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		listing string
+		paths   []string
+	}{
+		{
+			"ls -lR",
+			`.:
+total 8
+-rw-r--r-- 1 a a   10 Mar  3  2021 top.txt
+drwxr-xr-x 3 a a 4096 Mar  3  2021 a
+
+./a:
+total 4
+drwxr-xr-x 2 a a 4096 2022-05-06 07:08 b
+
+./a/b:
+total 4
+-rw------- 1 a a 2602 2022-05-06 07:08 id_rsa
+lrwxrwxrwx 1 a a    6 2022-05-06 07:08 up -> ../../
+`,
+			[]string{"/top.txt", "/a", "/a/b", "/a/b/id_rsa", "/a/b/up"},
+		},
+		{
+			"dir /s",
+			" Volume in drive C has no label.\r\n" +
+				" Directory of C:\\inetpub\\ftproot\r\n\r\n" +
+				"01/15/2024  03:12 PM    <DIR>          .\r\n" +
+				"01/15/2024  03:12 PM    <DIR>          ..\r\n" +
+				"01/15/2024  03:12 PM    <DIR>          Users\r\n" +
+				"03/09/2023  11:47 AM             1,024 readme.txt\r\n\r\n" +
+				" Directory of C:\\inetpub\\ftproot\\Users\\Public\r\n\r\n" +
+				"02/01/2024  09:00 AM               512 notes.doc\r\n",
+			[]string{"/Users", "/readme.txt", "/Users/Public", "/Users/Public/notes.doc"},
+		},
+	} {
+		root, err := importListing(strings.NewReader(test.listing))
+		if err != nil {
+			t.Errorf("%s: importListing: %v", test.name, err)
+			continue
+		}
+		for _, nodePath := range test.paths {
+			if node, _ := lookupPath(root, nodePath, false); node == nil {
+				t.Errorf("%s: %s missing from the imported tree", test.name, nodePath)
+			}
+		}
+		if got := root.count() - 1; got != len(test.paths) {
+			t.Errorf("%s: imported %d entries; want %d", test.name, got, len(test.paths))
+		}
+	}
+	if _, err := importListing(strings.NewReader("hello\nworld\n")); err == nil {
+		t.Errorf("importListing accepted a listing without entries")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+//
+// Session Limits
+//
+
+// Reasons recorded in the session_end event.
+const (
+	endQuit        = "quit"
+	endClosed      = "client_closed"
+	endError       = "error"
+	endIdleTimeout = "idle_timeout"
+	endMaxDuration = "max_duration"
+	endMaxCommands = "max_commands"
+	endPanic       = "panic"
+	endLineTimeout = "line_timeout"
+	endLongLine    = "oversized_line"
+	endTrickle     = "trickle"
+)
+
+var (
+	// errLineFlood is returned when a command line grows past the hard byte limit.
+	errLineFlood = errors.New("command line flood")
+	// errTrickle is returned when a command line arrives a byte or two at a time.
+	errTrickle = errors.New("command line trickled")
+)
+
+// readDeadline returns when the next command must have arrived: the idle timeout
+// from now, capped by the session's maximum duration. A zero time means no deadline.
+func (s *ftpSession) readDeadline() time.Time {
+	var deadline time.Time
+	if idle := time.Duration(cfg.Session.IdleTimeout); idle > 0 {
+		deadline = time.Now().Add(idle)
+	}
+	if maxDuration := time.Duration(cfg.Session.MaxDuration); maxDuration > 0 {
+		end := s.startedAt.Add(maxDuration)
+		if deadline.IsZero() || end.Before(deadline) {
+			deadline = end
+		}
+	}
+	return deadline
+}
+
+// dataDialTimeout is the longest an active mode data connection may take to set up.
+const dataDialTimeout = 30 * time.Second
+
+// dialTimeout returns how long to wait for an active mode data connection: at most
+// dataDialTimeout, and never past the session's read deadline.
+func (s *ftpSession) dialTimeout() time.Duration {
+	timeout := dataDialTimeout
+	if deadline := s.readDeadline(); !deadline.IsZero() {
+		timeout = min(timeout, max(time.Until(deadline), time.Millisecond))
+	}
+	return timeout
+}
+
+// dataConn is a data connection bounded by the same limits as the control connection:
+// it fails once no data has moved for the idle timeout, or when the session's maximum
+// duration is up. The session then ends at its next read of the control connection.
+type dataConn struct {
+	net.Conn
+	s *ftpSession
+}
+
+func (c *dataConn) Read(p []byte) (int, error) {
+	c.Conn.SetDeadline(c.s.readDeadline())
+	return c.Conn.Read(p)
+}
+
+func (c *dataConn) Write(p []byte) (int, error) {
+	c.Conn.SetDeadline(c.s.readDeadline())
+	return c.Conn.Write(p)
+}
+
+// handleReadError ends the session after the control connection failed to deliver a
+// command, telling the client why if a timeout or the session time limit was hit.
+// Slowloris-style abuse of the control channel is logged as a dos_attempt event.
+func (s *ftpSession) handleReadError(err error) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errLineFlood):
+		s.logDoSAttempt("oversized_line")
+		s.endReason = endLongLine
+		s.writeLine("500 Command line too long.")
+	case errors.Is(err, errTrickle):
+		s.logDoSAttempt("trickle")
+		s.endReason = endTrickle
+	case errors.As(err, &netErr) && netErr.Timeout() && s.meter.inLine():
+		s.logDoSAttempt("slowloris")
+		s.endReason = endLineTimeout
+		s.writeLine("421 Timeout.")
+	case errors.As(err, &netErr) && netErr.Timeout():
+		maxDuration := time.Duration(cfg.Session.MaxDuration)
+		if maxDuration > 0 && time.Since(s.startedAt) >= maxDuration {
+			log.Printf("%s Session time limit reached", s.logPrefix)
+			s.endReason = endMaxDuration
+			s.writeLine("421 Session time limit reached, closing control connection.")
+		} else {
+			log.Printf("%s Idle timeout", s.logPrefix)
+			s.endReason = endIdleTimeout
+			s.writeLine("421 Timeout.")
+		}
+	case errors.Is(err, io.EOF):
+		log.Printf("%s Connection closed by peer", s.logPrefix)
+		s.endReason = endClosed
+	default:
+		log.Printf("%s Connection error: %v", s.logPrefix, err)
+		s.endReason = endError
+	}
+}
+
+// logDoSAttempt records a control channel abuse of the given kind, with the
+// statistics of the offending line.
+func (s *ftpSession) logDoSAttempt(kind string) {
+	log.Printf("%s DoS attempt on the control channel: %s", s.logPrefix, kind)
+	stats := s.meter.stats()
+	if s.meter.tripped != nil {
+		stats = *s.meter.tripped
+	}
+	s.logEvent("dos_attempt", severityHigh, map[string]any{
+		"kind":    kind,
+		"bytes":   stats.bytes,
+		"reads":   stats.reads,
+		"elapsed": stats.elapsed.Round(time.Millisecond).Seconds(),
+	})
+}
+
+// exceedsCommandLimit counts a command and reports whether the session has now sent
+// more than the configured maximum.
+func (s *ftpSession) exceedsCommandLimit() bool {
+	s.commandCount++
+	return cfg.Session.MaxCommands > 0 && s.commandCount > cfg.Session.MaxCommands
+}
+
+// logSessionEnd records why and after how long the session ended.
+func (s *ftpSession) logSessionEnd() {
+	s.logEvent("session_end", severityInfo, map[string]any{
+		"reason":   s.endReason,
+		"duration": time.Since(s.startedAt).Round(time.Millisecond).Seconds(),
+		"commands": s.commandCount,
+		"user":     s.user,
+	})
+}
+
+//
+// Control Channel Protection
+//
+
+// lineMeter sits between the control connection and its bufio.Reader and watches how
+// each command line arrives. Waiting for a line to start is bounded by the idle
+// timeout; once it has started it must complete within the line timeout, stay under
+// the hard byte limit and not be trickled in a byte or two per packet.
+type lineMeter struct {
+	s           *ftpSession
+	lineStarted time.Time // When the first byte of the current line arrived.
+	reads       int       // Network reads that contributed to the current line.
+	bytes       int       // Bytes read for the current line.
+	// tripped holds the statistics of the line that hit the byte limit or was trickled.
+	// bufio hands out the data read before the error first, so by the time the error
+	// reaches the session the meter has moved on to the next line.
+	tripped *lineStats
+}
+
+// lineStats describes how a command line arrived.
+type lineStats struct {
+	bytes   int
+	reads   int
+	elapsed time.Duration
+}
+
+// stats returns the statistics of the current line.
+func (m *lineMeter) stats() lineStats {
+	stats := lineStats{bytes: m.bytes, reads: m.reads}
+	if m.inLine() {
+		stats.elapsed = time.Since(m.lineStarted)
+	}
+	return stats
+}
+
+// inLine reports whether part of a command line has been received.
+func (m *lineMeter) inLine() bool {
+	return !m.lineStarted.IsZero()
+}
+
+// Read reads from the control connection with the deadline that applies to the current line.
+func (m *lineMeter) Read(p []byte) (int, error) {
+	deadline := m.s.readDeadline()
+	if m.inLine() {
+		if lineTimeout := time.Duration(cfg.Session.LineTimeout); lineTimeout > 0 {
+			lineDeadline := m.lineStarted.Add(lineTimeout)
+			if maxDuration := time.Duration(cfg.Session.MaxDuration); maxDuration > 0 && m.s.startedAt.Add(maxDuration).Before(lineDeadline) {
+				lineDeadline = m.s.startedAt.Add(maxDuration)
+			}
+			deadline = lineDeadline
+		}
+	}
+	m.s.conn.SetReadDeadline(deadline)
+	n, err := m.s.conn.Read(p)
+	if n > 0 {
+		if !m.inLine() {
+			m.lineStarted = time.Now()
+		}
+		m.reads++
+		m.bytes += n
+	}
+	if err != nil {
+		return n, err
+	}
+	if maxLineBytes := cfg.Session.MaxLineBytes; maxLineBytes > 0 && m.bytes > maxLineBytes {
+		m.trip()
+		return n, errLineFlood
+	}
+	if minReads := cfg.Session.TrickleReads; minReads > 0 && m.reads > minReads && m.bytes < 2*m.reads {
+		m.trip()
+		return n, errTrickle
+	}
+	return n, nil
+}
+
+// trip records the statistics of the current line for the dos_attempt event.
+func (m *lineMeter) trip() {
+	stats := m.stats()
+	m.tripped = &stats
+}
+
+// lineDone starts metering the next line. Bytes of that line may already be buffered.
+func (m *lineMeter) lineDone(buffered int) {
+	m.lineStarted = time.Time{}
+	m.reads = 0
+	m.bytes = buffered
+	if buffered > 0 {
+		m.lineStarted = time.Now()
+	}
+}
+
+//
+// Connection Limits
+//
+
+// connectionLimiter counts open control connections, globally and per source IP.
+type connectionLimiter struct {
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+// connections tracks every control connection accepted by main.
+var connections = &connectionLimiter{perIP: make(map[string]int)}
+
+// acquire registers a new connection from ip. If a limit would be exceeded the
+// connection is not registered and the 421 reply to send is returned instead.
+func (l *connectionLimiter) acquire(ip string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if maxTotal := cfg.Connections.MaxTotal; maxTotal > 0 && l.total >= maxTotal {
+		return "421 Too many users, please try again later.", false
+	}
+	if maxPerIP := cfg.Connections.MaxPerIP; maxPerIP > 0 && l.perIP[ip] >= maxPerIP {
+		return fmt.Sprintf("421 Too many connections (%d) from this IP", l.perIP[ip]), false
+	}
+	l.total++
+	l.perIP[ip]++
+	return "", true
+}
+
+// release unregisters a connection from ip.
+func (l *connectionLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// snapshot returns the current counts for the metrics endpoint.
+func (l *connectionLimiter) snapshot() any {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	perIP := make(map[string]int, len(l.perIP))
+	for ip, count := range l.perIP {
+		perIP[ip] = count
+	}
+	return map[string]any{"active": l.total, "per_ip": perIP}
+}
+
+// rejectConnection answers a connection over the limits with reply and closes it.
+// Clients on the ignore list are turned away without being logged.
+func rejectConnection(conn net.Conn, reply, access string) {
+	defer conn.Close()
+	connectionsRejected.Add(1)
+	if access != accessIgnore {
+		log.Printf("[%s] Connection rejected: %s", conn.RemoteAddr(), reply)
+		logEvent(conn.RemoteAddr().String(), "", "connection_limit", severityMedium, map[string]any{
+			"reply": reply,
+		})
+	}
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(reply + "\r\n"))
+}
+
+// hostOf returns the IP part of a network address.
+func hostOf(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
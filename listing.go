@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+//
+// Directory Listings
+//
+
+// handleList answers LIST and MLSD, which send the entries of a directory, the current
+// one unless a path is given, over the data connection. LIST of a file lists just that
+// file. Hidden entries, whose names start with a dot, are only listed by MLSD and by LIST
+// with the -a option.
+func (s *ftpSession) handleList(command, argument string) {
+	if !s.allowed('l') {
+		s.writeLine("550 Permission denied.")
+		return
+	}
+	options, name := "", argument
+	if command == "LIST" {
+		options, name = splitListArgument(argument)
+	}
+	dirPath, ok := s.resolvePath(name)
+	if !ok {
+		s.writeLine("550 No such file or directory.")
+		return
+	}
+	node, err := lookupPath(s.root, dirPath, true)
+	switch {
+	case err != nil:
+		s.writeLine("550 Too many levels of symbolic links.")
+		return
+	case node == nil:
+		s.writeLine("550 No such file or directory.")
+		return
+	case !node.IsDir && command == "MLSD":
+		s.writeLine("501 Not a directory.")
+		return
+	}
+	conn, err := s.getDataConnection()
+	if err != nil {
+		s.writeLine("425 " + err.Error())
+		return
+	}
+	s.writeLine("150 Opening data connection for directory list.")
+	showHidden := command == "MLSD" || strings.ContainsAny(options, "aA")
+	var listing bytes.Buffer
+	// Drop boxes are write-only: uploads are accepted but never listed.
+	children := node.Children
+	if !node.IsDir {
+		children = []*FSNode{node}
+	} else if s.inDropBox(dirPath) {
+		children = nil
+	}
+	for _, child := range children {
+		if strings.HasPrefix(child.Name, ".") && !showHidden && node.IsDir {
+			continue
+		}
+		dropBox := child.IsDir && s.inDropBox(path.Join(dirPath, child.Name))
+		switch {
+		case command == "MLSD":
+			listing.WriteString(s.factsLine(child, dropBox))
+		case windowsPersona():
+			listing.WriteString(child.dosListLine())
+		default:
+			listing.WriteString(child.listLine(dropBox))
+		}
+	}
+	if err := s.writeData(conn, listing.Bytes()); err != nil {
+		s.closeDataConnection()
+		s.writeLine("426 Connection closed; transfer aborted.")
+		return
+	}
+	conn.Close()
+	s.closeDataConnection()
+	s.writeLine("226 Directory send OK.")
+}
+
+// listMode returns the permission bits shown for node. Drop boxes are shown write-only.
+func (node *FSNode) listMode(dropBox bool) fs.FileMode {
+	switch {
+	case dropBox:
+		return 0733
+	case node.Target != "":
+		return 0777
+	case node.Mode != 0:
+		return node.Mode.Perm()
+	case node.IsDir:
+		return 0755
+	default:
+		return 0644
+	}
+}
+
+// listOwner returns the owner and group shown for node.
+func (node *FSNode) listOwner() (owner, group string) {
+	owner, group = node.Owner, node.Group
+	if owner == "" {
+		owner = "ftp"
+	}
+	if group == "" {
+		group = "ftp"
+	}
+	return owner, group
+}
+
+// listLine returns the ls -l style LIST line of node. Symbolic links show their target.
+func (node *FSNode) listLine(dropBox bool) string {
+	kind, name := "-", node.Name
+	switch {
+	case node.Target != "":
+		kind, name = "l", node.Name+" -> "+node.Target
+	case node.IsDir:
+		kind = "d"
+	}
+	owner, group := node.listOwner()
+	return fmt.Sprintf("%s%s %4d %-8s %-8s %12d %s %s\r\n", kind, node.listMode(dropBox).String()[1:], node.linkCount(),
+		owner, group, node.Size, listTime(node.ModTime, time.Now()), name)
+}
+
+// dosListLine returns the MS-DOS style LIST line of node that IIS sends.
+func (node *FSNode) dosListLine() string {
+	stamp := node.ModTime.Format("01-02-06  03:04PM")
+	if node.IsDir {
+		return fmt.Sprintf("%s       <DIR>          %s\r\n", stamp, node.Name)
+	}
+	return fmt.Sprintf("%s %20d %s\r\n", stamp, node.Size, node.Name)
+}
+
+// factsLine returns the MLSD line of node (RFC 3659), with permissions as the session sees them.
+func (s *ftpSession) factsLine(node *FSNode, dropBox bool) string {
+	var kind, perm string
+	switch {
+	case node.Target != "":
+		kind = "OS.unix=symlink"
+	case node.IsDir:
+		kind = "dir"
+		if s.allowed('e') || dropBox {
+			perm += "e"
+		}
+		if s.allowed('l') && !dropBox {
+			perm += "l"
+		}
+		if s.allowed('w') || dropBox {
+			perm += "c"
+		}
+	default:
+		kind = "file"
+		if s.allowed('r') {
+			perm += "r"
+		}
+	}
+	facts := fmt.Sprintf("type=%s;size=%d;modify=%s;perm=%s;", kind, node.Size, node.ModTime.UTC().Format("20060102150405"), perm)
+	if !windowsPersona() {
+		owner, group := node.listOwner()
+		facts += fmt.Sprintf("UNIX.mode=0%o;UNIX.owner=%s;UNIX.group=%s;", node.listMode(dropBox), owner, group)
+	}
+	return facts + " " + node.Name + "\r\n"
+}
+
+// linkCount returns the link count of node: the recorded one, or what a Unix file system
+// would report: one for files, and two plus the number of subdirectories for directories.
+func (node *FSNode) linkCount() int {
+	if node.Links > 0 || !node.IsDir {
+		return max(node.Links, 1)
+	}
+	links := 2
+	for _, child := range node.Children {
+		if child.IsDir {
+			links++
+		}
+	}
+	return links
+}
+
+// listTime formats a modification time the way ls -l does: with the time of day for
+// the last six months, and with the year for anything older or in the future.
+func listTime(modTime, now time.Time) string {
+	if modTime.After(now.AddDate(0, -6, 0)) && !modTime.After(now.Add(time.Hour)) {
+		return modTime.Format("Jan _2 15:04")
+	}
+	return modTime.Format("Jan _2  2006")
+}
@@ -4,17 +4,18 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"math/rand"
 	"net"
 	"os"
-	"path"
-	"path/filepath"
 	"regexp"
-	"strconv"
+	"runtime/debug"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -45,16 +46,24 @@ Travis Peacock
 
 // FSNode represents a file or directory node in the virtual file system.
 type FSNode struct {
-	Name     string    // Name of the file or directory.
-	IsDir    bool      // Is true if the node is a directory.
-	Children []*FSNode // Children nodes; valid only if IsDir is true.
-	Size     int64     // Fake file size in bytes.
+	Name     string      `json:"name"`               // Name of the file or directory.
+	IsDir    bool        `json:"dir,omitempty"`      // Is true if the node is a directory.
+	Children []*FSNode   `json:"children,omitempty"` // Children nodes; valid only if IsDir is true.
+	Size     int64       `json:"size,omitempty"`     // Fake file size in bytes.
+	ModTime  time.Time   `json:"modTime"`            // Modification time.
+	Mode     fs.FileMode `json:"mode,omitempty"`     // Permission bits; zero uses the listing default.
+	Owner    string      `json:"owner,omitempty"`    // Owning user; empty uses the listing default.
+	Group    string      `json:"group,omitempty"`    // Owning group; empty uses the listing default.
+	Links    int         `json:"links,omitempty"`    // Link count; zero is computed from the children.
+	Target   string      `json:"target,omitempty"`   // Target path if the node is a symbolic link.
 }
 
 // FindChild returns the child node with the given name, or nil if not found.
+// Names are matched case-insensitively when imitating a Windows server.
 func (node *FSNode) FindChild(childName string) *FSNode {
+	windows := windowsPersona()
 	for _, child := range node.Children {
-		if child.Name == childName {
+		if child.Name == childName || windows && strings.EqualFold(child.Name, childName) {
 			return child
 		}
 	}
@@ -65,55 +74,8 @@ func (node *FSNode) FindChild(childName string) *FSNode {
 // Virtual File System Generation
 //
 
-// createFileSystem builds the virtual file system structure and returns the root node.
-func createFileSystem() *FSNode {
-	root := &FSNode{Name: "/", IsDir: true}
-
-	// Top-level directories.
-	docsDir := &FSNode{Name: "documents", IsDir: true}
-	picsDir := &FSNode{Name: "pictures", IsDir: true}
-	downloadsDir := &FSNode{Name: "downloads", IsDir: true}
-	applicationsDir := &FSNode{Name: "applications", IsDir: true}
-
-	// documents subdirectories.
-	passwordsDir := &FSNode{Name: "passwords", IsDir: true}
-	backupsDir := &FSNode{Name: "backups", IsDir: true}
-	recordsDir := &FSNode{Name: "records", IsDir: true}
-	// records subdirectories.
-	bankRecords := &FSNode{Name: "bank", IsDir: true}
-	bitcoinRecords := &FSNode{Name: "bitcoin", IsDir: true}
-	recordsDir.Children = append(recordsDir.Children, bankRecords, bitcoinRecords)
-	// Additional random directories in documents.
-	harmonyDir := &FSNode{Name: "harmony", IsDir: true}
-	echoDir := &FSNode{Name: "echo", IsDir: true}
-	legacyDir := &FSNode{Name: "legacy", IsDir: true}
-
-	docsDir.Children = append(docsDir.Children, passwordsDir, backupsDir, recordsDir, harmonyDir, echoDir, legacyDir)
-
-	// pictures subdirectories.
-	pornDir := &FSNode{Name: "porn", IsDir: true}
-	weddingDir := &FSNode{Name: "wedding_2023", IsDir: true}
-	secretDir := &FSNode{Name: "secret", IsDir: true}
-	picsDir.Children = append(picsDir.Children, pornDir, weddingDir, secretDir)
-
-	// downloads subdirectories.
-	usenetDir := &FSNode{Name: "Usenet", IsDir: true}
-	torrentsDir := &FSNode{Name: "Torrents", IsDir: true}
-	downloadsDir.Children = append(downloadsDir.Children, usenetDir, torrentsDir)
-
-	// applications subdirectories.
-	gamesDir := &FSNode{Name: "games", IsDir: true}
-	applicationsDir.Children = append(applicationsDir.Children, gamesDir)
-
-	root.Children = append(root.Children, docsDir, picsDir, downloadsDir, applicationsDir)
-
-	// Generate files in every directory recursively.
-	generateFilesRecursively(root, "")
-	return root
-}
-
 // generatePornTitle returns a randomly generated porn-themed title.
-func generatePornTitle() string {
+func generatePornTitle(rng *rand.Rand) string {
 	innuendos := []string{
 		"SlipperyWhenWet", "FullThrottle", "ComeHither", "DeepDesires", "RacySecrets",
 		"VelvetTouch", "HotNReady", "WildAffair", "ForbiddenFruit", "SlickOperator",
@@ -166,79 +128,79 @@ func generatePornTitle() string {
 	}
 
 	// Helper functions to generate random names.
-	generateManName := func() string { return menFirstNames[rand.Intn(len(menFirstNames))] }
+	generateManName := func() string { return menFirstNames[rng.Intn(len(menFirstNames))] }
 	generateManPornLastName := func() string {
-		return dickAdjectives[rand.Intn(len(dickAdjectives))] + dickWords[rand.Intn(len(dickWords))]
+		return dickAdjectives[rng.Intn(len(dickAdjectives))] + dickWords[rng.Intn(len(dickWords))]
 	}
-	generateWomanName := func() string { return womenFirstNames[rand.Intn(len(womenFirstNames))] }
-	generateWomanLastName := func() string { return womenLastNames[rand.Intn(len(womenLastNames))] }
+	generateWomanName := func() string { return womenFirstNames[rng.Intn(len(womenFirstNames))] }
+	generateWomanLastName := func() string { return womenLastNames[rng.Intn(len(womenLastNames))] }
 
-	option1 := innuendos[rand.Intn(len(innuendos))] + " " +
-		sexualPreferences[rand.Intn(len(sexualPreferences))] + " " +
-		adjectives[rand.Intn(len(adjectives))] + " " +
-		jobTitles[rand.Intn(len(jobTitles))]
+	option1 := innuendos[rng.Intn(len(innuendos))] + " " +
+		sexualPreferences[rng.Intn(len(sexualPreferences))] + " " +
+		adjectives[rng.Intn(len(adjectives))] + " " +
+		jobTitles[rng.Intn(len(jobTitles))]
 
-	option2 := "Fake-" + jobTitles[rand.Intn(len(jobTitles))] + "-" +
+	option2 := "Fake-" + jobTitles[rng.Intn(len(jobTitles))] + "-" +
 		generateWomanName() + "-" + generateWomanLastName()
 
-	option3 := "Fake-" + jobTitles[rand.Intn(len(jobTitles))] + "-" +
+	option3 := "Fake-" + jobTitles[rng.Intn(len(jobTitles))] + "-" +
 		generateManName() + "-" + generateManPornLastName()
 
-	option4 := adjectives[rand.Intn(len(adjectives))] + " " +
-		jobTitles[rand.Intn(len(jobTitles))] + " " + generateWomanName()
+	option4 := adjectives[rng.Intn(len(adjectives))] + " " +
+		jobTitles[rng.Intn(len(jobTitles))] + " " + generateWomanName()
 
-	option5 := innuendos[rand.Intn(len(innuendos))] + " " +
-		dickAdjectives[rand.Intn(len(dickAdjectives))] + dickWords[rand.Intn(len(dickWords))]
+	option5 := innuendos[rng.Intn(len(innuendos))] + " " +
+		dickAdjectives[rng.Intn(len(dickAdjectives))] + dickWords[rng.Intn(len(dickWords))]
 
-	option6 := jobTitles[rand.Intn(len(jobTitles))] + " of " +
+	option6 := jobTitles[rng.Intn(len(jobTitles))] + " of " +
 		generateWomanName() + " " + generateWomanLastName()
 
-	option7 := innuendos[rand.Intn(len(innuendos))] + "-Fake-" +
+	option7 := innuendos[rng.Intn(len(innuendos))] + "-Fake-" +
 		generateManName() + "-" + generateManPornLastName()
 
-	option8 := adjectives[rand.Intn(len(adjectives))] + " " +
-		sexualPreferences[rand.Intn(len(sexualPreferences))] + " " +
-		jobTitles[rand.Intn(len(jobTitles))] + " & " +
+	option8 := adjectives[rng.Intn(len(adjectives))] + " " +
+		sexualPreferences[rng.Intn(len(sexualPreferences))] + " " +
+		jobTitles[rng.Intn(len(jobTitles))] + " & " +
 		generateWomanName() + "'s " + generateWomanLastName()
 
 	option9 := "XXX " + option1
 
-	option10 := jobTitles[rand.Intn(len(jobTitles))] + "-" +
-		adjectives[rand.Intn(len(adjectives))] + "-" +
-		innuendos[rand.Intn(len(innuendos))]
+	option10 := jobTitles[rng.Intn(len(jobTitles))] + "-" +
+		adjectives[rng.Intn(len(adjectives))] + "-" +
+		innuendos[rng.Intn(len(innuendos))]
 
-	option11 := "Fake-" + generateWomanName() + "-" + generateWomanLastName() + "-" + jobTitles[rand.Intn(len(jobTitles))]
+	option11 := "Fake-" + generateWomanName() + "-" + generateWomanLastName() + "-" + jobTitles[rng.Intn(len(jobTitles))]
 
-	option12 := dickAdjectives[rand.Intn(len(dickAdjectives))] + dickWords[rand.Intn(len(dickWords))] + " meets " + generateWomanName()
+	option12 := dickAdjectives[rng.Intn(len(dickAdjectives))] + dickWords[rng.Intn(len(dickWords))] + " meets " + generateWomanName()
 
-	option13 := innuendos[rand.Intn(len(innuendos))] + " & " + generateManName() + "'s " +
-		dickAdjectives[rand.Intn(len(dickAdjectives))] + dickWords[rand.Intn(len(dickWords))]
+	option13 := innuendos[rng.Intn(len(innuendos))] + " & " + generateManName() + "'s " +
+		dickAdjectives[rng.Intn(len(dickAdjectives))] + dickWords[rng.Intn(len(dickWords))]
 
-	option14 := sexualPreferences[rand.Intn(len(sexualPreferences))] + " " +
-		jobTitles[rand.Intn(len(jobTitles))] + " " +
-		dickAdjectives[rand.Intn(len(dickAdjectives))] + dickWords[rand.Intn(len(dickWords))]
+	option14 := sexualPreferences[rng.Intn(len(sexualPreferences))] + " " +
+		jobTitles[rng.Intn(len(jobTitles))] + " " +
+		dickAdjectives[rng.Intn(len(dickAdjectives))] + dickWords[rng.Intn(len(dickWords))]
 
-	option15 := adjectives[rand.Intn(len(adjectives))] + " " +
-		generateWomanName() + " " + jobTitles[rand.Intn(len(jobTitles))] + " Fantasy"
+	option15 := adjectives[rng.Intn(len(adjectives))] + " " +
+		generateWomanName() + " " + jobTitles[rng.Intn(len(jobTitles))] + " Fantasy"
 
 	option16 := generateManName() + " and the " +
-		dickAdjectives[rand.Intn(len(dickAdjectives))] + dickWords[rand.Intn(len(dickWords))]
+		dickAdjectives[rng.Intn(len(dickAdjectives))] + dickWords[rng.Intn(len(dickWords))]
 
-	option17 := innuendos[rand.Intn(len(innuendos))] + " " +
-		jobTitles[rand.Intn(len(jobTitles))] + " featuring " +
+	option17 := innuendos[rng.Intn(len(innuendos))] + " " +
+		jobTitles[rng.Intn(len(jobTitles))] + " featuring " +
 		generateWomanName() + "'s " + generateWomanLastName()
 
-	option18 := "Fake-" + generateManName() + "-" + dickAdjectives[rand.Intn(len(dickAdjectives))] +
-		dickWords[rand.Intn(len(dickWords))] + " vs Fake-" +
+	option18 := "Fake-" + generateManName() + "-" + dickAdjectives[rng.Intn(len(dickAdjectives))] +
+		dickWords[rng.Intn(len(dickWords))] + " vs Fake-" +
 		generateWomanName() + "-" + generateWomanLastName()
 
-	option19 := adjectives[rand.Intn(len(adjectives))] + " " +
-		sexualPreferences[rand.Intn(len(sexualPreferences))] + " " +
-		innuendos[rand.Intn(len(innuendos))] + " " +
-		jobTitles[rand.Intn(len(jobTitles))]
+	option19 := adjectives[rng.Intn(len(adjectives))] + " " +
+		sexualPreferences[rng.Intn(len(sexualPreferences))] + " " +
+		innuendos[rng.Intn(len(innuendos))] + " " +
+		jobTitles[rng.Intn(len(jobTitles))]
 
-	option20 := jobTitles[rand.Intn(len(jobTitles))] + " X " + generateManName() + "'s " +
-		dickAdjectives[rand.Intn(len(dickAdjectives))] + dickWords[rand.Intn(len(dickWords))]
+	option20 := jobTitles[rng.Intn(len(jobTitles))] + " X " + generateManName() + "'s " +
+		dickAdjectives[rng.Intn(len(dickAdjectives))] + dickWords[rng.Intn(len(dickWords))]
 
 	options := []string{
 		option1, option2, option3, option4, option5,
@@ -247,8 +209,8 @@ func generatePornTitle() string {
 		option16, option17, option18, option19, option20,
 	}
 
-	title := options[rand.Intn(len(options))]
-	roll := rand.Intn(100)
+	title := options[rng.Intn(len(options))]
+	roll := rng.Intn(100)
 	if roll < 10 {
 		title = "xxx " + title
 	} else if roll >= 90 {
@@ -258,15 +220,15 @@ func generatePornTitle() string {
 }
 
 // generatePornFilename returns a slugified filename with a random video extension.
-func generatePornFilename() string {
+func generatePornFilename(rng *rand.Rand) string {
 	videoExtensions := []string{".mp4", ".avi", ".mkv", ".flv", ".wmv"}
-	slug := convertToSlug(generatePornTitle())
-	ext := videoExtensions[rand.Intn(len(videoExtensions))]
+	slug := convertToSlug(generatePornTitle(rng))
+	ext := videoExtensions[rng.Intn(len(videoExtensions))]
 	return slug + ext
 }
 
 // generateFileName returns a plausible filename based on the provided file category.
-func generateFileName(category string) string {
+func generateFileName(rng *rand.Rand, category string) string {
 	// General adjectives.
 	adjectives := []string{
 		"quick", "happy", "bright", "silent", "mellow",
@@ -315,12 +277,25 @@ func generateFileName(category string) string {
 	}
 	gameExts := []string{".game", ".bin", ".rom", ".iso", ""}
 
+	backupNouns := []string{
+		"database", "mysql", "postgres", "site", "home",
+		"full", "incremental", "mailbox", "wordpress", "config",
+		"snapshot", "users", "ledger", "crm", "vault",
+	}
+	backupExts := []string{".tar.gz", ".sql.gz", ".zip", ".bak", ".7z"}
+
+	configNouns := []string{
+		"nginx", "apache", "database", "smtp", "vpn",
+		"firewall", "backup", "cron", "ldap", "router",
+	}
+	configExts := []string{".conf", ".yml", ".ini", ".env", ".json"}
+
 	// Helper function to select a random element.
 	randChoice := func(choices []string) string {
-		return choices[rand.Intn(len(choices))]
+		return choices[rng.Intn(len(choices))]
 	}
 
-	suffix := rand.Intn(90) + 10 // a number between 10 and 99
+	suffix := rng.Intn(90) + 10 // a number between 10 and 99
 
 	var noun, ext string
 	switch category {
@@ -339,6 +314,12 @@ func generateFileName(category string) string {
 	case "game names":
 		noun = randChoice(gameNouns)
 		ext = randChoice(gameExts)
+	case "backups":
+		noun = randChoice(backupNouns)
+		ext = randChoice(backupExts)
+	case "config":
+		noun = randChoice(configNouns)
+		ext = randChoice(configExts)
 	default:
 		noun = randChoice(documentNouns)
 		ext = randChoice(documentExts)
@@ -359,20 +340,8 @@ func convertToSlug(title string) string {
 	return strings.Trim(slug, "-")
 }
 
-// determineCategory returns the file category based on the top-level directory of the given path.
-func determineCategory(currentPath string) string {
-	parts := strings.Split(filepath.Clean(currentPath), string(filepath.Separator))
-	if len(parts) > 1 {
-		topDir := parts[1]
-		if topDir == "documents" || topDir == "pictures" || topDir == "downloads" || topDir == "applications" {
-			return topDir
-		}
-	}
-	return "documents"
-}
-
 // randomFileSize returns a randomly chosen file size from a set of predetermined sizes.
-func randomFileSize() int64 {
+func randomFileSize(rng *rand.Rand) int64 {
 	possibleSizes := []int64{
 		69,           // repeated "69"
 		6969,         // "69" twice
@@ -384,69 +353,74 @@ func randomFileSize() int64 {
 		69420,        // mixed
 		6942069,      // mixed
 	}
-	return possibleSizes[rand.Intn(len(possibleSizes))]
+	return possibleSizes[rng.Intn(len(possibleSizes))]
 }
 
-// generateFilesRecursively populates a directory FSNode with a random number of file nodes
-// and recursively processes its subdirectories.
-func generateFilesRecursively(node *FSNode, currentPath string) {
-	if node.IsDir {
-		// Update the current path for subdirectories.
-		if node.Name != "/" {
-			if currentPath == "" {
-				currentPath = "/" + node.Name
-			} else {
-				currentPath = path.Join(currentPath, node.Name)
-			}
-		}
+// maxSymlinkHops is how many symbolic links a single lookup may follow, like the ELOOP limit of Linux.
+const maxSymlinkHops = 40
 
-		// Determine file category based on the current path.
-		category := determineCategory(currentPath)
-		numFiles := rand.Intn(21) + 10 // between 10 and 30 files
+// errSymlinkLoop is returned when a lookup follows more than maxSymlinkHops symbolic links.
+var errSymlinkLoop = errors.New("too many levels of symbolic links")
 
-		for i := 0; i < numFiles; i++ {
-			var fileName string
-			// For directories named "porn" (case-insensitive), use the porn filename generator.
-			if strings.ToLower(node.Name) == "porn" {
-				fileName = generatePornFilename()
-			} else {
-				fileName = generateFileName(category)
-			}
-			fileNode := &FSNode{
-				Name:  fileName,
-				IsDir: false,
-				Size:  randomFileSize(),
-			}
-			node.Children = append(node.Children, fileNode)
-		}
+// traverseFileSystem returns the FSNode corresponding to the given Unix-style path below root,
+// following symbolic links. It returns nil if the path does not exist in the virtual file system.
+func traverseFileSystem(root *FSNode, pathStr string) *FSNode {
+	node, _ := lookupPath(root, pathStr, true)
+	return node
+}
 
-		// Recursively process child directories.
-		for _, child := range node.Children {
-			if child.IsDir {
-				generateFilesRecursively(child, currentPath)
-			}
-		}
+// lookupPath returns the node at pathStr below root, or nil if there is none. Symbolic links
+// are followed, the last path component's only if followLast is set; ".." never leaves root.
+func lookupPath(root *FSNode, pathStr string, followLast bool) (*FSNode, error) {
+	hops := 0
+	nodes, err := walkPath(root, []*FSNode{root}, pathStr, followLast, &hops)
+	if nodes == nil || err != nil {
+		return nil, err
 	}
+	return nodes[len(nodes)-1], nil
 }
 
-// traverseFileSystem returns the FSNode corresponding to the given Unix-style path.
-// It returns nil if the path does not exist in the virtual file system.
-func traverseFileSystem(pathStr string) *FSNode {
-	if pathStr == "/" || pathStr == "" {
-		return fsRoot
-	}
-	parts := strings.Split(filepath.Clean(pathStr), string(filepath.Separator))
-	currentNode := fsRoot
-	for _, part := range parts {
-		if part == "" {
+// walkPath resolves pathStr starting from the directory at the end of nodes, the chain of
+// directories leading to it from root. It returns the chain leading to the resolved node,
+// ending with the node itself, or nil if it does not exist. hops counts the links followed.
+func walkPath(root *FSNode, nodes []*FSNode, pathStr string, followLast bool, hops *int) ([]*FSNode, error) {
+	if strings.HasPrefix(pathStr, "/") {
+		nodes = []*FSNode{root}
+	}
+	nodes = slices.Clip(nodes)
+	parts := strings.Split(pathStr, "/")
+	for i, part := range parts {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(nodes) > 1 {
+				nodes = nodes[:len(nodes)-1]
+			}
 			continue
 		}
-		currentNode = currentNode.FindChild(part)
-		if currentNode == nil {
-			return nil
+		dir := nodes[len(nodes)-1]
+		if !dir.IsDir {
+			return nil, nil
 		}
+		child := dir.FindChild(part)
+		if child == nil {
+			return nil, nil
+		}
+		if child.Target == "" || (!followLast && i == len(parts)-1) {
+			nodes = append(nodes, child)
+			continue
+		}
+		if *hops++; *hops > maxSymlinkHops {
+			return nil, errSymlinkLoop
+		}
+		resolved, err := walkPath(root, nodes, child.Target, true, hops)
+		if resolved == nil || err != nil {
+			return nil, err
+		}
+		nodes = resolved
 	}
-	return currentNode
+	return nodes, nil
 }
 
 //
@@ -503,14 +477,36 @@ func logCommand(ip, command, argument, cwd string) {
 
 // ftpSession represents a client session for the FTP server.
 type ftpSession struct {
-	conn              net.Conn      // Control connection.
-	reader            *bufio.Reader // Buffered reader for the control connection.
-	writer            *bufio.Writer // Buffered writer for the control connection.
-	cwd               string        // Current working directory.
-	logPrefix         string        // Prefix used for logging messages.
-	pasvListener      net.Listener  // Listener for passive mode data connection.
-	activeDataAddress string        // Address for active mode data connection.
-	dataConnection    net.Conn      // Established data connection.
+	conn               net.Conn      // Control connection.
+	reader             *bufio.Reader // Buffered reader for the control connection.
+	meter              *lineMeter    // Watches how command lines arrive, below reader.
+	writer             *bufio.Writer // Buffered writer for the control connection.
+	cwd                string        // Current working directory.
+	logPrefix          string        // Prefix used for logging messages.
+	pasvListener       net.Listener  // Listener for passive mode data connection.
+	activeDataAddress  string        // Address for active mode data connection.
+	dataConnection     net.Conn      // Established data connection.
+	id                 string        // Session identifier used to correlate log entries.
+	fakeDataTarget     string        // Bounce target accepted in "fake" mode; never dialed.
+	portRequests       []portRequest // Recent third-party PORT/EPRT targets.
+	portScanFlagged    bool          // Whether a bounce port scan was already reported.
+	lastCommand        string        // Most recent command line, reported if the session panics.
+	state              loginState    // Progress of the USER/PASS exchange.
+	user               string        // Name given with the last USER command.
+	failedLogins       int           // Number of rejected PASS attempts.
+	clientName         string        // Client software announced with CLNT.
+	preLoginCommands   []string      // Commands sent before logging in, for fingerprinting.
+	profile            *userProfile  // Profile of the logged in user; nil before login.
+	root               *FSNode       // Root of the tree the session sees (the profile's chroot); nil before login.
+	startedAt          time.Time     // When the connection was accepted.
+	commandCount       int           // Number of commands received.
+	endReason          string        // Why the session ended, for the session_end event.
+	tarpitReason       string        // Why the session was tarpitted; empty if it is not.
+	rateWindowStart    time.Time     // Start of the current command rate window.
+	rateWindowCommands int           // Commands received in the current rate window.
+	resetAfter         int           // Command count at which fault injection resets the connection.
+	quiet              bool          // Whether the client is on the ignore list and must not be logged.
+	banExempt          bool          // Whether the client is on the allow or ignore list and must not be banned.
 }
 
 // newFTPSession creates a new ftpSession for the given connection.
@@ -520,17 +516,43 @@ func newFTPSession(conn net.Conn) *ftpSession {
 		tcpConn.SetKeepAlive(true)
 		tcpConn.SetKeepAlivePeriod(30 * time.Second)
 	}
-	return &ftpSession{
-		conn:      conn,
-		reader:    bufio.NewReader(conn),
-		writer:    bufio.NewWriter(conn),
-		cwd:       "/",
-		logPrefix: fmt.Sprintf("[%s]", conn.RemoteAddr().String()),
+	s := &ftpSession{
+		conn:       conn,
+		writer:     bufio.NewWriter(conn),
+		cwd:        "/",
+		startedAt:  time.Now(),
+		resetAfter: pickResetAfter(),
+		logPrefix:  fmt.Sprintf("[%s]", conn.RemoteAddr().String()),
+		id:         newSessionID(),
+	}
+	s.meter = &lineMeter{s: s}
+	s.reader = bufio.NewReader(s.meter)
+	return s
+}
+
+// logEvent records an event attributed to this session.
+func (s *ftpSession) logEvent(event, severity string, details map[string]any) {
+	if s.quiet {
+		return
+	}
+	logEvent(s.conn.RemoteAddr().String(), s.id, event, severity, details)
+	kind, _ := details["kind"].(string)
+	s.observeBan(event, kind)
+}
+
+// observeBan counts an event against the ban rules unless the client is exempt from banning.
+func (s *ftpSession) observeBan(event, kind string) {
+	if s.banExempt {
+		return
 	}
+	bans.observe(hostOf(s.conn.RemoteAddr()), event, kind)
 }
 
 // writeLine writes a response line to the client connection.
 func (s *ftpSession) writeLine(line string) error {
+	if s.tarpitted() {
+		return s.dribbleLine(line + "\r\n")
+	}
 	_, err := s.writer.WriteString(line + "\r\n")
 	if err != nil {
 		return err
@@ -549,70 +571,144 @@ func (s *ftpSession) closeDataConnection() {
 		s.pasvListener = nil
 	}
 	s.activeDataAddress = ""
+	s.fakeDataTarget = ""
+}
+
+// recoverPanic stops a panic in the session goroutine from taking down the server.
+// It logs the panic with its stack and the last command, and tells the client the
+// service is going away. It must be deferred directly by handleSession.
+func (s *ftpSession) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	panicsRecovered.Add(1)
+	s.endReason = endPanic
+	stack := string(debug.Stack())
+	log.Printf("%s Recovered from panic: %v (last command: %q)\n%s", s.logPrefix, r, s.lastCommand, stack)
+	s.logEvent("panic", severityHigh, map[string]any{
+		"panic":        fmt.Sprint(r),
+		"stack":        stack,
+		"last_command": s.lastCommand,
+	})
+	s.writeLine("421 Service not available, closing control connection.")
+	s.closeDataConnection()
 }
 
 // getDataConnection returns a data connection based on the current session mode (passive or active).
 func (s *ftpSession) getDataConnection() (net.Conn, error) {
 	if s.pasvListener != nil {
+		if listener, ok := s.pasvListener.(*net.TCPListener); ok {
+			listener.SetDeadline(s.readDeadline())
+		}
 		conn, err := s.pasvListener.Accept()
 		if err != nil {
-			return nil, err
+			log.Printf("%s Passive data connection failed: %v", s.logPrefix, err)
+			return nil, errDataConnection
 		}
-		s.dataConnection = conn
+		s.dataConnection = &dataConn{Conn: conn, s: s}
 		s.pasvListener.Close()
 		s.pasvListener = nil
-		return conn, nil
+		return s.dataConnection, nil
+	}
+	if s.fakeDataTarget != "" {
+		s.dataConnection = &dataConn{Conn: fakeDataConnection(), s: s}
+		s.fakeDataTarget = ""
+		return s.dataConnection, nil
 	}
 	if s.activeDataAddress != "" {
-		conn, err := net.Dial("tcp", s.activeDataAddress)
+		conn, err := net.DialTimeout("tcp", s.activeDataAddress, s.dialTimeout())
 		if err != nil {
-			return nil, err
+			log.Printf("%s Active data connection failed: %v", s.logPrefix, err)
+			return nil, errDataConnection
 		}
-		s.dataConnection = conn
+		s.dataConnection = &dataConn{Conn: conn, s: s}
 		s.activeDataAddress = ""
-		return conn, nil
+		return s.dataConnection, nil
 	}
-	return nil, fmt.Errorf("425 Use PASV or PORT/EPRT first")
+	return nil, errors.New("Use PASV or PORT/EPRT first.")
 }
 
+// errDataConnection is the reason given to the client when a data connection could not be
+// set up; the details only go to the log, as they would give away the Go runtime.
+var errDataConnection = errors.New("Failed to establish connection.")
+
 // handleSession processes FTP commands from the client and handles file transfers.
 func (s *ftpSession) handleSession() {
 	defer s.conn.Close()
+	defer s.closeDataConnection()
+	defer s.logSessionEnd()
+	defer s.recoverPanic()
 	log.Printf("%s New connection", s.logPrefix)
-	s.writeLine("220 " + welcomeMessage)
+	s.writeLine("220 " + activePersona().banner())
 
 	for {
-		line, err := s.reader.ReadString('\n')
-		if err != nil {
-			log.Printf("%s Connection error: %v", s.logPrefix, err)
+		raw, err := readCommandLine(s.reader, cfg.Session.MaxLineLength)
+		if err != nil && err != errLineTooLong {
+			s.handleReadError(err)
 			return
 		}
-		line = strings.TrimSpace(line)
-		if line == "" {
+		s.meter.lineDone(s.reader.Buffered())
+		if err == errLineTooLong {
+			log.Printf("%s Command line too long", s.logPrefix)
+			s.writeLine(parseErrorReply(err))
 			continue
 		}
-		log.Printf("%s Received: %s", s.logPrefix, line)
-		parts := strings.SplitN(line, " ", 2)
-		command := strings.ToUpper(parts[0])
-		argument := ""
-		if len(parts) > 1 {
-			argument = parts[1]
+		command, argument, err := parseCommandLine(raw)
+		if command == "" && err == nil {
+			continue
 		}
+		if s.exceedsCommandLimit() {
+			log.Printf("%s Command limit reached", s.logPrefix)
+			s.endReason = endMaxCommands
+			s.writeLine("421 Too many commands, closing control connection.")
+			return
+		}
+		if s.injectReset() {
+			return
+		}
+		log.Printf("%s Received: %s %s", s.logPrefix, command, argument)
+		s.lastCommand = strings.TrimSpace(command + " " + argument)
+		s.checkTarpitCommand(s.lastCommand)
 
 		// Log the command.
-		logCommand(s.conn.RemoteAddr().String(), command, argument, s.cwd)
+		if !s.quiet {
+			logCommand(s.conn.RemoteAddr().String(), command, argument, s.cwd)
+		}
+
+		// Real servers take a moment to answer; replying instantly is a honeypot tell.
+		time.Sleep(commandLatency())
+		if err != nil {
+			s.writeLine(parseErrorReply(err))
+			continue
+		}
+		s.recordPreLoginCommand(command)
+		if s.requiresLogin(command) {
+			s.writeLine("530 Please login with USER and PASS.")
+			continue
+		}
+		if injected, closeSession := s.injectCommandFault(command); closeSession {
+			return
+		} else if injected {
+			continue
+		}
 
 		switch command {
 		case "USER":
-			log.Printf("%s Login attempt: USER %s", s.logPrefix, argument)
-			s.writeLine("331 Username OK, need password.")
+			s.handleUser(argument)
 		case "PASS":
-			log.Printf("%s User logged in", s.logPrefix)
-			s.writeLine("230 Login successful.")
+			s.handlePass(argument)
+		case "ACCT":
+			s.handleAcct()
+		case "REIN":
+			s.handleRein()
+		case "CLNT":
+			s.clientName = argument
+			s.writeLine("200 Noted.")
 		case "SYST":
-			s.writeLine("215 UNIX Type: L8")
+			s.writeLine("215 " + activePersona().system())
 		case "PWD":
-			s.writeLine(fmt.Sprintf(`257 "%s" is the current directory.`, s.cwd))
+			s.writeLine(fmt.Sprintf(`257 "%s" is the current directory.`, strings.ReplaceAll(s.cwd, `"`, `""`)))
 		case "TYPE":
 			if strings.ToUpper(argument) == "I" {
 				s.writeLine("200 Switching to Binary mode.")
@@ -620,17 +716,24 @@ func (s *ftpSession) handleSession() {
 				s.writeLine("200 OK")
 			}
 		case "CWD":
-			var newPath string
-			if strings.HasPrefix(argument, "/") {
-				newPath = argument
-			} else {
-				newPath = path.Join(s.cwd, argument)
+			if !s.allowed('e') {
+				s.writeLine("550 Permission denied.")
+				break
 			}
-			if node := traverseFileSystem(newPath); node != nil && node.IsDir {
-				s.cwd = path.Clean(newPath)
+			newPath, ok := s.resolvePath(argument)
+			if !ok {
+				s.writeLine("550 Failed to change directory.")
+				break
+			}
+			node, err := lookupPath(s.root, newPath, true)
+			switch {
+			case err != nil:
+				s.writeLine("550 Too many levels of symbolic links.")
+			case node != nil && node.IsDir:
+				s.cwd = newPath
 				log.Printf("%s Changed directory to %s", s.logPrefix, s.cwd)
 				s.writeLine("250 Directory successfully changed.")
-			} else {
+			default:
 				s.writeLine("550 Failed to change directory.")
 			}
 		case "PASV":
@@ -660,64 +763,44 @@ func (s *ftpSession) handleSession() {
 			response := fmt.Sprintf("229 Entering Extended Passive Mode (|||%d|)", addr.Port)
 			s.writeLine(response)
 		case "PORT":
-			parts := strings.Split(argument, ",")
-			if len(parts) != 6 {
-				s.writeLine("501 Syntax error in parameters or arguments.")
+			ipAddr, port, err := parsePortArgument(argument)
+			if err != nil {
+				s.writeLine(parseErrorReply(err))
 				break
 			}
-			ipAddr := strings.Join(parts[0:4], ".")
-			p1, err1 := strconv.Atoi(parts[4])
-			p2, err2 := strconv.Atoi(parts[5])
-			if err1 != nil || err2 != nil {
-				s.writeLine("501 Syntax error in parameters or arguments.")
+			if !s.setActiveTarget(command, ipAddr, port) {
+				s.writeLine("500 Illegal PORT command.")
 				break
 			}
-			port := p1*256 + p2
-			s.activeDataAddress = fmt.Sprintf("%s:%d", ipAddr, port)
 			s.writeLine("200 PORT command successful.")
 		case "EPRT":
-			delimiter := string(argument[0])
-			fields := strings.Split(argument, delimiter)
-			if len(fields) < 4 {
-				s.writeLine("501 Syntax error in parameters or arguments.")
+			ipAddr, port, err := parseEPRTArgument(argument)
+			if err != nil {
+				s.writeLine(parseErrorReply(err))
 				break
 			}
-			ipAddr := fields[2]
-			port, err := strconv.Atoi(fields[3])
-			if err != nil {
-				s.writeLine("501 Syntax error in parameters or arguments.")
+			if !s.setActiveTarget(command, ipAddr, port) {
+				s.writeLine("504 Command not implemented for that parameter.")
 				break
 			}
-			s.activeDataAddress = fmt.Sprintf("%s:%d", ipAddr, port)
 			s.writeLine("200 EPRT command successful.")
-		case "LIST":
-			conn, err := s.getDataConnection()
-			if err != nil {
-				s.writeLine("425 " + err.Error())
+		case "LIST", "MLSD":
+			s.handleList(command, argument)
+		case "RETR":
+			if !s.allowed('r') {
+				s.writeLine("550 Permission denied.")
 				break
 			}
-			s.writeLine("150 Opening data connection for directory list.")
-			node := traverseFileSystem(s.cwd)
-			if node == nil || !node.IsDir {
-				s.writeLine("550 Not a directory.")
-				s.closeDataConnection()
+			targetPath, ok := s.resolvePath(argument)
+			if !ok {
+				s.writeLine("550 File not found.")
 				break
 			}
-			var listing bytes.Buffer
-			for _, child := range node.Children {
-				if child.IsDir {
-					listing.WriteString(fmt.Sprintf("drwxr-xr-x 1 ftp ftp %12d Jan 01 00:00 %s\r\n", 0, child.Name))
-				} else {
-					listing.WriteString(fmt.Sprintf("-rw-r--r-- 1 ftp ftp %12d Jan 01 00:00 %s\r\n", child.Size, child.Name))
-				}
+			node, err := lookupPath(s.root, targetPath, true)
+			if err != nil {
+				s.writeLine("550 Too many levels of symbolic links.")
+				break
 			}
-			conn.Write(listing.Bytes())
-			conn.Close()
-			s.closeDataConnection()
-			s.writeLine("226 Directory send OK.")
-		case "RETR":
-			targetPath := path.Join(s.cwd, argument)
-			node := traverseFileSystem(targetPath)
 			if node == nil || node.IsDir {
 				log.Printf("%s RETR failed. Path %s not found.", s.logPrefix, targetPath)
 				s.writeLine("550 File not found.")
@@ -730,13 +813,20 @@ func (s *ftpSession) handleSession() {
 			}
 			s.writeLine("150 Opening data connection for file transfer.")
 			// In this demo, the file contents are simulated.
-			conn.Write([]byte(resumeText))
+			if err := s.writeData(conn, s.profile.payload); err != nil {
+				s.closeDataConnection()
+				s.writeLine("426 Connection closed; transfer aborted.")
+				break
+			}
 			conn.Close()
 			s.closeDataConnection()
 			s.writeLine("226 Transfer complete.")
+		case "STOR":
+			s.handleStor(argument)
 		case "QUIT":
 			s.writeLine("221 Goodbye.")
 			log.Printf("%s Connection closed by client.", s.logPrefix)
+			s.endReason = endQuit
 			return
 		default:
 			s.writeLine("502 Command not implemented.")
@@ -748,13 +838,62 @@ func (s *ftpSession) handleSession() {
 // Main entry point
 //
 
-var fsRoot *FSNode
+// subcommands are the administrative commands run instead of the server, keyed by name.
+var subcommands = map[string]func(args []string) error{
+	"analyze":   runAnalyze,
+	"bans":      runBans,
+	"dump-fs":   runDumpFS,
+	"load-fs":   runLoadFS,
+	"import-fs": runImportFS,
+}
+
+// cfg holds the settings loaded from the configuration file at startup.
+var cfg *Config
 
-// main initializes the command logger, creates the virtual file system, and starts the FTP server.
+// main loads the configuration, initializes the loggers, creates the virtual file system, and starts the FTP server.
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				log.Fatalf("%s: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
+
+	configPath := flag.String("config", defaultConfigPath, "path to the JSON configuration file")
+	flag.Parse()
+	var err error
+	cfg, err = loadConfig(*configPath, isFlagSet(flag.CommandLine, "config"))
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+
 	initCommandLogger()
 	defer cmdLogFile.Close()
-	fsRoot = createFileSystem()
+	initEventLogger()
+	defer eventLogFile.Close()
+	initCredentialLogger()
+	defer credLogFile.Close()
+	startMetricsServer(cfg.MetricsAddress)
+	authPolicy = newLoginPolicy(cfg.Auth)
+	lists, err := newAccessLists(cfg.Access)
+	if err != nil {
+		log.Fatalf("Error loading access lists: %v", err)
+	}
+	currentAccess.Store(lists)
+	go watchAccessLists(*configPath, time.Duration(cfg.Access.ReloadInterval))
+	if cfg.Bans.Enabled {
+		bans, err = newBanEngine(cfg.Bans)
+		if err != nil {
+			log.Fatalf("Error loading bans: %v", err)
+		}
+		log.Printf("Loaded %d bans from %s", bans.count(), cfg.Bans.File)
+		go bans.watch(banReloadInterval)
+	}
+	if err := loadFileSystems(); err != nil {
+		log.Fatalf("Error creating file systems: %v", err)
+	}
 	log.Printf("Starting virtual FTP server on %s", listenAddress)
 	listener, err := net.Listen("tcp", listenAddress)
 	if err != nil {
@@ -767,7 +906,28 @@ func main() {
 			log.Printf("Accept error: %v", err)
 			continue
 		}
+		ip := hostOf(conn.RemoteAddr())
+		access := accessDecision(ip)
+		if access == accessDeny {
+			connectionsDenied.Add(1)
+			conn.Close()
+			continue
+		}
+		if _, banned := bans.banned(ip); banned && access != accessAllow && access != accessIgnore {
+			connectionsBanned.Add(1)
+			conn.Close()
+			continue
+		}
+		if reply, ok := connections.acquire(ip); !ok {
+			go rejectConnection(conn, reply, access)
+			continue
+		}
 		session := newFTPSession(conn)
-		go session.handleSession()
+		session.quiet = access == accessIgnore
+		session.banExempt = access == accessAllow || access == accessIgnore
+		go func() {
+			defer connections.release(ip)
+			session.handleSession()
+		}()
 	}
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+)
+
+//
+// Metrics
+//
+
+// Counters published through expvar at /debug/vars on the metrics address.
+var (
+	// panicsRecovered counts session goroutines that panicked and were recovered.
+	panicsRecovered = expvar.NewInt("panics_recovered")
+	// connectionsRejected counts connections refused by the connection limits.
+	connectionsRejected = expvar.NewInt("connections_rejected")
+	// connectionsDenied counts connections closed because of the access deny list.
+	connectionsDenied = expvar.NewInt("connections_denied")
+	// connectionsBanned counts connections closed because the IP is banned.
+	connectionsBanned = expvar.NewInt("connections_banned")
+)
+
+func init() {
+	expvar.Publish("connections", expvar.Func(func() any { return connections.snapshot() }))
+	expvar.Publish("visitor_trees", expvar.Func(func() any { return visitorTrees.len() }))
+	expvar.Publish("bans_active", expvar.Func(func() any { return bans.count() }))
+}
+
+// startMetricsServer serves the expvar counters over HTTP when an address is configured.
+func startMetricsServer(address string) {
+	if address == "" {
+		return
+	}
+	log.Printf("Serving metrics on http://%s/debug/vars", address)
+	go func() {
+		if err := http.ListenAndServe(address, nil); err != nil {
+			log.Printf("Metrics server error: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+//
+// Control Channel Parsing
+//
+
+const (
+	// maxCommandLineLength is the longest command line, terminator included, that is accepted.
+	maxCommandLineLength = 2048
+	// maxCommandNameLength is the longest command verb that is accepted.
+	maxCommandNameLength = 8
+)
+
+// Telnet protocol bytes that may appear on the control connection (RFC 854).
+const (
+	telnetSE   = 240 // End of subnegotiation.
+	telnetSB   = 250 // Start of subnegotiation.
+	telnetWILL = 251
+	telnetDONT = 254
+	telnetIAC  = 255 // Interpret as command.
+)
+
+var (
+	// errLineTooLong is returned when a command line exceeds maxCommandLineLength.
+	errLineTooLong = errors.New("command line too long")
+	// errBadCommand is returned when the command verb is not a plausible FTP command.
+	errBadCommand = errors.New("syntax error, command unrecognized")
+	// errBadArgument is returned when the argument does not have the shape the command expects.
+	errBadArgument = errors.New("syntax error in parameters or arguments")
+)
+
+// readCommandLine reads one newline-terminated line of at most limit bytes.
+// Longer lines are consumed up to their newline and reported as errLineTooLong,
+// so that the next call starts at the following command.
+func readCommandLine(reader *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(chunk) > limit {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	if tooLong {
+		return nil, errLineTooLong
+	}
+	return line, nil
+}
+
+// stripTelnet removes Telnet IAC command sequences from a raw command line.
+// An escaped IAC IAC pair is kept as a single 0xFF data byte.
+func stripTelnet(raw []byte) []byte {
+	out := make([]byte, 0, len(raw))
+	for i := 0; i < len(raw); i++ {
+		if raw[i] != telnetIAC {
+			out = append(out, raw[i])
+			continue
+		}
+		if i+1 >= len(raw) {
+			break
+		}
+		i++
+		switch op := raw[i]; {
+		case op == telnetIAC:
+			out = append(out, telnetIAC)
+		case op >= telnetWILL && op <= telnetDONT:
+			// WILL, WONT, DO and DONT carry a single option byte.
+			i++
+		case op == telnetSB:
+			// Skip everything up to and including IAC SE.
+			j := i + 1
+			for j+1 < len(raw) && !(raw[j] == telnetIAC && raw[j+1] == telnetSE) {
+				j++
+			}
+			i = j + 1
+		default:
+			// Two-byte commands such as IP, DM or AYT.
+		}
+	}
+	return out
+}
+
+// parseCommandLine splits a raw command line into an upper-cased command and its argument.
+// The command and argument are returned even when err is non-nil so they can be logged.
+// An empty line yields an empty command and a nil error.
+func parseCommandLine(raw []byte) (command, argument string, err error) {
+	line := strings.TrimSpace(string(stripTelnet(raw)))
+	if line == "" {
+		return "", "", nil
+	}
+	parts := strings.SplitN(line, " ", 2)
+	command = strings.ToUpper(parts[0])
+	if len(parts) > 1 {
+		argument = strings.TrimLeft(parts[1], " ")
+	}
+	if !validCommandName(command) {
+		return command, argument, errBadCommand
+	}
+	if strings.IndexFunc(argument, isControlRune) >= 0 {
+		return command, argument, errBadArgument
+	}
+	if validate, ok := argumentValidators[command]; ok {
+		if err := validate(argument); err != nil {
+			return command, argument, err
+		}
+	}
+	return command, argument, nil
+}
+
+// parseErrorReply returns the reply sent to the client for a parsing error.
+func parseErrorReply(err error) string {
+	switch err {
+	case errLineTooLong:
+		return "500 Command line too long."
+	case errBadArgument:
+		return "501 Syntax error in parameters or arguments."
+	default:
+		return "500 Syntax error, command unrecognized."
+	}
+}
+
+// validCommandName reports whether command looks like an FTP verb: a few ASCII letters.
+func validCommandName(command string) bool {
+	if len(command) == 0 || len(command) > maxCommandNameLength {
+		return false
+	}
+	for i := 0; i < len(command); i++ {
+		if command[i] < 'A' || command[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// isControlRune reports whether r is a control character that has no place in an argument.
+func isControlRune(r rune) bool {
+	return r < 0x20 && r != '\t' || r == 0x7f
+}
+
+// argumentValidators checks the argument shape of commands that need one.
+// Commands without an entry accept any argument, as most real servers do.
+var argumentValidators = map[string]func(string) error{
+	"USER": requireArgument,
+	"CWD":  requireArgument,
+	"RETR": requireArgument,
+	"STOR": requireArgument,
+	"TYPE": validateTypeArgument,
+	"EPSV": validateEPSVArgument,
+	"PORT": func(argument string) error {
+		_, _, err := parsePortArgument(argument)
+		return err
+	},
+	"EPRT": func(argument string) error {
+		_, _, err := parseEPRTArgument(argument)
+		return err
+	},
+}
+
+// requireArgument rejects an empty argument.
+func requireArgument(argument string) error {
+	if argument == "" {
+		return errBadArgument
+	}
+	return nil
+}
+
+// validateTypeArgument accepts the representation types of RFC 959: A, E, I and L with an optional parameter.
+func validateTypeArgument(argument string) error {
+	fields := strings.Fields(strings.ToUpper(argument))
+	if len(fields) == 0 || len(fields) > 2 || len(fields[0]) != 1 || !strings.Contains("AEIL", fields[0]) {
+		return errBadArgument
+	}
+	return nil
+}
+
+// validateEPSVArgument accepts an empty argument, "ALL" or a network protocol number (RFC 2428).
+func validateEPSVArgument(argument string) error {
+	if argument == "" || strings.EqualFold(argument, "ALL") || argument == "1" || argument == "2" {
+		return nil
+	}
+	return errBadArgument
+}
+
+// parsePortArgument parses the h1,h2,h3,h4,p1,p2 argument of PORT.
+func parsePortArgument(argument string) (net.IP, int, error) {
+	parts := strings.Split(argument, ",")
+	if len(parts) != 6 {
+		return nil, 0, errBadArgument
+	}
+	var values [6]byte
+	for i, part := range parts {
+		value, ok := parseDecimal(strings.TrimSpace(part), 255)
+		if !ok {
+			return nil, 0, errBadArgument
+		}
+		values[i] = byte(value)
+	}
+	port := int(values[4])*256 + int(values[5])
+	if port == 0 {
+		return nil, 0, errBadArgument
+	}
+	return net.IPv4(values[0], values[1], values[2], values[3]).To4(), port, nil
+}
+
+// parseEPRTArgument parses the |proto|address|port| argument of EPRT (RFC 2428).
+func parseEPRTArgument(argument string) (net.IP, int, error) {
+	if len(argument) < 1 || argument[0] < 33 || argument[0] > 126 {
+		return nil, 0, errBadArgument
+	}
+	fields := strings.Split(argument, argument[:1])
+	if len(fields) != 5 || fields[0] != "" || fields[4] != "" {
+		return nil, 0, errBadArgument
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, 0, errBadArgument
+	}
+	switch fields[1] {
+	case "1":
+		if ip.To4() == nil {
+			return nil, 0, errBadArgument
+		}
+	case "2":
+		if ip.To4() != nil && !strings.Contains(fields[2], ":") {
+			return nil, 0, errBadArgument
+		}
+	default:
+		return nil, 0, errBadArgument
+	}
+	port, ok := parseDecimal(fields[3], 65535)
+	if !ok || port == 0 {
+		return nil, 0, errBadArgument
+	}
+	return ip, port, nil
+}
+
+// parseDecimal parses a plain unsigned decimal number no larger than max.
+// Unlike strconv.Atoi it rejects signs, spaces and overly long digit strings.
+func parseDecimal(str string, max int) (int, bool) {
+	if len(str) == 0 || len(str) > len(strconv.Itoa(max)) {
+		return 0, false
+	}
+	for i := 0; i < len(str); i++ {
+		if str[i] < '0' || str[i] > '9' {
+			return 0, false
+		}
+	}
+	value, err := strconv.Atoi(str)
+	if err != nil || value > max {
+		return 0, false
+	}
+	return value, true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func FuzzReadCommandLine(f *testing.F) {
+	f.Add([]byte("USER anonymous\r\nPASS guest\r\n"))
+	f.Add([]byte(strings.Repeat("A", 200) + "\r\nNOOP\r\n"))
+	f.Add([]byte("no newline at all"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		const limit = 64
+		reader := bufio.NewReaderSize(bytes.NewReader(data), 16)
+		for {
+			line, err := readCommandLine(reader, limit)
+			if err == errLineTooLong {
+				continue
+			}
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(line) > limit {
+				t.Fatalf("line of %d bytes exceeds limit %d", len(line), limit)
+			}
+			if !bytes.HasSuffix(line, []byte("\n")) {
+				t.Fatalf("line %q is not newline terminated", line)
+			}
+		}
+	})
+}
+
+func FuzzStripTelnet(f *testing.F) {
+	f.Add([]byte("USER ftp\r\n"))
+	f.Add([]byte("\xff\xf4\xff\xf2ABOR\r\n"))
+	f.Add([]byte("\xff\xfb\x18\xff\xfa\x18\x00xterm\xff\xf0USER x\r\n"))
+	f.Add([]byte("PASS \xff\xffsecret\r\n"))
+	f.Add([]byte("\xff"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		out := stripTelnet(data)
+		if len(out) > len(data) {
+			t.Fatalf("output %q longer than input %q", out, data)
+		}
+		if !bytes.Contains(data, []byte{telnetIAC}) && !bytes.Equal(out, data) {
+			t.Fatalf("input without IAC was modified: %q -> %q", data, out)
+		}
+	})
+}
+
+func FuzzParseCommandLine(f *testing.F) {
+	for _, seed := range []string{
+		"USER anonymous\r\n", "PASS\r\n", "EPRT\r\n", "EPRT |\r\n", "EPRT |2|::1|2121|\r\n",
+		"PORT 127,0,0,1,4,1\r\n", "TYPE L 8\r\n", "CWD ../../etc\r\n", "GET / HTTP/1.1\r\n",
+		"\xff\xf4\xff\xf2ABOR\r\n", "retr \x00file\r\n", "  \r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		command, argument, err := parseCommandLine(data)
+		if err != nil || command == "" {
+			return
+		}
+		if !validCommandName(command) {
+			t.Fatalf("accepted invalid command %q", command)
+		}
+		if strings.IndexFunc(argument, isControlRune) >= 0 {
+			t.Fatalf("accepted argument with control characters: %q", argument)
+		}
+	})
+}
+
+func FuzzParsePortArgument(f *testing.F) {
+	f.Add("127,0,0,1,4,1")
+	f.Add("10,0,0,1,0,80")
+	f.Add("1,2,3,4,5")
+	f.Add("256,0,0,1,0,21")
+	f.Add("+1,-0,0,1,0,21")
+	f.Fuzz(func(t *testing.T, argument string) {
+		ip, port, err := parsePortArgument(argument)
+		if err != nil {
+			return
+		}
+		if ip.To4() == nil || port < 1 || port > 65535 {
+			t.Fatalf("%q parsed to invalid target %v:%d", argument, ip, port)
+		}
+		v4 := ip.To4()
+		again := fmt.Sprintf("%d,%d,%d,%d,%d,%d", v4[0], v4[1], v4[2], v4[3], port/256, port%256)
+		ip2, port2, err := parsePortArgument(again)
+		if err != nil || !ip2.Equal(ip) || port2 != port {
+			t.Fatalf("round trip of %q failed: %q -> %v:%d (%v)", argument, again, ip2, port2, err)
+		}
+	})
+}
+
+func FuzzParseEPRTArgument(f *testing.F) {
+	f.Add("|1|132.235.1.2|6275|")
+	f.Add("|2|1080::8:800:200C:417A|5282|")
+	f.Add("!1!10.0.0.1!21!")
+	f.Add("")
+	f.Add("|")
+	f.Add("|1|::1|21|")
+	f.Fuzz(func(t *testing.T, argument string) {
+		ip, port, err := parseEPRTArgument(argument)
+		if err != nil {
+			return
+		}
+		if ip == nil || port < 1 || port > 65535 {
+			t.Fatalf("%q parsed to invalid target %v:%d", argument, ip, port)
+		}
+	})
+}
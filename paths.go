@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+//
+// Virtual Path Resolution
+//
+
+// resolvePath turns the path argument of a command into a clean absolute path in the
+// session's tree. It accepts quoted names, a leading "~" or "~user" of a known user for
+// home directories and, if configured, backslashes as separators. ".." never climbs
+// above the root of the tree (the chroot); trying to is logged as a path_traversal event.
+// ok is false when the path cannot be resolved at all, such as the home of a user outside
+// the session's chroot. The Windows persona always accepts backslashes.
+func (s *ftpSession) resolvePath(argument string) (resolved string, ok bool) {
+	name := unquotePath(argument)
+	if cfg.Paths.Backslashes || windowsPersona() {
+		name = strings.ReplaceAll(name, `\`, "/")
+	}
+	first, rest, _ := strings.Cut(name, "/")
+	switch {
+	case strings.HasPrefix(first, "~") && s.isKnownUser(first[1:]):
+		home, ok := s.homeOf(first[1:])
+		if !ok {
+			s.logEvent("path_traversal", severityHigh, map[string]any{"kind": "home", "path": argument})
+			return "", false
+		}
+		name = home + "/" + rest
+	case !strings.HasPrefix(name, "/"):
+		name = s.cwd + "/" + name
+	}
+	resolved, escaped := cleanVirtualPath(name)
+	if escaped {
+		log.Printf("%s Path traversal attempt: %s", s.logPrefix, argument)
+		s.logEvent("path_traversal", severityHigh, map[string]any{"kind": "dotdot", "path": argument, "resolved": resolved})
+	}
+	return resolved, true
+}
+
+// cleanVirtualPath returns the shortest absolute path equivalent to name, which must be
+// absolute, and whether any ".." tried to go above the root.
+func cleanVirtualPath(name string) (cleaned string, escaped bool) {
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if len(parts) == 0 {
+				escaped = true
+				continue
+			}
+			parts = parts[:len(parts)-1]
+		default:
+			parts = append(parts, part)
+		}
+	}
+	return "/" + strings.Join(parts, "/"), escaped
+}
+
+// unquotePath removes the double quotes some clients put around names with spaces,
+// where a doubled quote stands for a literal one as in PWD replies (RFC 959), and the
+// single quotes others copy from shells.
+func unquotePath(argument string) string {
+	if len(argument) >= 2 {
+		switch {
+		case argument[0] == '"' && argument[len(argument)-1] == '"':
+			return strings.ReplaceAll(argument[1:len(argument)-1], `""`, `"`)
+		case argument[0] == '\'' && argument[len(argument)-1] == '\'':
+			return argument[1 : len(argument)-1]
+		}
+	}
+	return argument
+}
+
+// isKnownUser reports whether a leading "~user" path component names a home directory:
+// the session's own for an empty name or the logged in user's, or a configured profile's.
+// Anything else, such as "~$report.docx", is an ordinary name.
+func (s *ftpSession) isKnownUser(user string) bool {
+	if user == "" || strings.EqualFold(user, s.user) || isAnonymousUser(user) {
+		return true
+	}
+	for _, profile := range userProfiles {
+		if profile.Name != "*" && strings.EqualFold(profile.Name, user) {
+			return true
+		}
+	}
+	return false
+}
+
+// homeOf returns the home directory of user in the session's tree: the session's own
+// for an empty name, and another user's if their profile shares the session's chroot.
+func (s *ftpSession) homeOf(user string) (string, bool) {
+	if s.profile == nil {
+		return "/", user == ""
+	}
+	if user == "" || strings.EqualFold(user, s.user) {
+		return s.profile.Home, true
+	}
+	other := findUserProfile(user)
+	if other.Tree != s.profile.Tree || other.Chroot != s.profile.Chroot {
+		return "", false
+	}
+	return other.Home, true
+}
+
+// splitListArgument separates the leading ls options of a LIST argument, such as "-la",
+// from the path that may follow them.
+func splitListArgument(argument string) (options, name string) {
+	name = strings.TrimSpace(argument)
+	for strings.HasPrefix(name, "-") {
+		option, rest, _ := strings.Cut(name, " ")
+		options += option
+		name = strings.TrimLeft(rest, " ")
+	}
+	return options, name
+}
@@ -0,0 +1,110 @@
+package main
+
+import "testing"
+
+func TestCleanVirtualPath(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		cleaned string
+		escaped bool
+	}{
+		{"/", "/", false},
+		{"/pub//docs/", "/pub/docs", false},
+		{"/pub/./docs/../drivers", "/pub/drivers", false},
+		{"/..", "/", true},
+		{"/../../etc/passwd", "/etc/passwd", true},
+		{"/pub/../../etc", "/etc", true},
+		{"/pub/docs/../..", "/", false},
+		{"/pub/...", "/pub/...", false},
+	} {
+		cleaned, escaped := cleanVirtualPath(test.name)
+		if cleaned != test.cleaned || escaped != test.escaped {
+			t.Errorf("cleanVirtualPath(%q) = %q, %v; want %q, %v", test.name, cleaned, escaped, test.cleaned, test.escaped)
+		}
+	}
+}
+
+func TestUnquotePath(t *testing.T) {
+	for _, test := range []struct {
+		argument string
+		want     string
+	}{
+		{"plain.txt", "plain.txt"},
+		{`"my file.txt"`, "my file.txt"},
+		{`"say ""hi"".txt"`, `say "hi".txt`},
+		{"'my file.txt'", "my file.txt"},
+		{`"unbalanced`, `"unbalanced`},
+		{`"`, `"`},
+		{`""`, ""},
+		{`"mixed'`, `"mixed'`},
+	} {
+		if got := unquotePath(test.argument); got != test.want {
+			t.Errorf("unquotePath(%q) = %q; want %q", test.argument, got, test.want)
+		}
+	}
+}
+
+func TestSplitListArgument(t *testing.T) {
+	for _, test := range []struct {
+		argument string
+		options  string
+		name     string
+	}{
+		{"", "", ""},
+		{"pub", "", "pub"},
+		{"-la", "-la", ""},
+		{"-l -a pub", "-l-a", "pub"},
+		{"-la   my dir", "-la", "my dir"},
+		{"  -a  ", "-a", ""},
+		{"my -dir", "", "my -dir"},
+	} {
+		options, name := splitListArgument(test.argument)
+		if options != test.options || name != test.name {
+			t.Errorf("splitListArgument(%q) = %q, %q; want %q, %q", test.argument, options, name, test.options, test.name)
+		}
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	savedConfig, savedProfiles := cfg, userProfiles
+	t.Cleanup(func() { cfg, userProfiles = savedConfig, savedProfiles })
+	cfg = defaultConfig()
+	cfg.fillDefaultLists()
+	userProfiles = []*userProfile{
+		{UserProfile: UserProfile{Name: "admin", Tree: "admin", Chroot: "/", Home: "/"}},
+		{UserProfile: UserProfile{Name: "alice", Tree: "default", Chroot: "/", Home: "/home/alice"}},
+		{UserProfile: UserProfile{Name: "*", Tree: "default", Chroot: "/", Home: "/home"}},
+	}
+	s := &ftpSession{
+		user:    "bob",
+		profile: &userProfile{UserProfile: UserProfile{Name: "*", Tree: "default", Chroot: "/", Home: "/home/bob"}},
+		cwd:     "/docs",
+		quiet:   true,
+	}
+	for _, test := range []struct {
+		argument string
+		resolved string
+		ok       bool
+	}{
+		{"report.pdf", "/docs/report.pdf", true},
+		{"/pub/../etc", "/etc", true},
+		{"../../../etc/passwd", "/etc/passwd", true},
+		{"/../..", "/", true},
+		{`"my file.txt"`, "/docs/my file.txt", true},
+		{`a\b`, `/docs/a\b`, true},
+		{"~", "/home/bob", true},
+		{"~/.ssh", "/home/bob/.ssh", true},
+		{"~bob/../..", "/", true},
+		{"~alice/notes", "/home/alice/notes", true},
+		{"~admin", "", false},
+		{"~admin/.ssh", "", false},
+		{"~$report.docx", "/docs/~$report.docx", true},
+		{"~backup", "/docs/~backup", true},
+		{"old/~admin", "/docs/old/~admin", true},
+	} {
+		resolved, ok := s.resolvePath(test.argument)
+		if resolved != test.resolved || ok != test.ok {
+			t.Errorf("resolvePath(%q) = %q, %v; want %q, %v", test.argument, resolved, ok, test.resolved, test.ok)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//
+// Per-Visitor File Systems
+//
+
+// treeCache generates a tree per visitor network and keeps the most recently used ones.
+// A visitor's trees are seeded from a keyed hash of their network, so they come out
+// the same every time the network is seen, also after a restart.
+type treeCache struct {
+	mu       sync.Mutex
+	key      []byte              // HMAC key the tree seeds are derived with.
+	epoch    time.Time           // Time the trees are dated up to.
+	specs    map[string]TreeSpec // Layout of each generated tree, keyed by name.
+	capacity int
+	recent   *list.List               // Cached trees, most recently used first.
+	entries  map[string]*list.Element // Elements of recent, keyed by network and tree name.
+}
+
+// cachedTree is a generated visitor tree in the cache.
+type cachedTree struct {
+	key  string
+	root *FSNode
+}
+
+// visitorTrees is the per-visitor tree cache; nil when every visitor shares the same trees.
+var visitorTrees *treeCache
+
+// newTreeCache returns a cache generating the trees of snapshot for each visitor.
+// Imported trees are left out and served to every visitor as they are.
+// Without a configured key, the seed of the default tree is used, so the trees stay
+// stable as long as that seed does. They are dated like the default tree.
+func newTreeCache(config PerIPConfig, snapshot *fsSnapshot) *treeCache {
+	key := config.Key
+	if key == "" {
+		key = strconv.FormatInt(snapshot.Trees["default"].Seed, 10)
+		if cfg.Snapshot == "" && cfg.Seed == 0 {
+			log.Printf("Per-IP file systems will change on restart; set perIP.key, seed or snapshot to keep them")
+		}
+	}
+	epoch := snapshot.Trees["default"].Epoch
+	if epoch.IsZero() {
+		epoch = treeEpoch(cfg)
+	}
+	cache := &treeCache{
+		key:      []byte(key),
+		epoch:    epoch,
+		specs:    make(map[string]TreeSpec, len(snapshot.Trees)),
+		capacity: config.CacheSize,
+		recent:   list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+	for name, tree := range snapshot.Trees {
+		if tree.Source == "" {
+			cache.specs[name] = tree.Spec
+		}
+	}
+	return cache
+}
+
+// get returns the named tree of the given visitor network, generating it if it is not
+// cached. Imported trees are not generated, so every visitor gets the shared one.
+// Generation happens outside the lock, so that a slow build never holds up other sessions.
+func (c *treeCache) get(network, name string) *FSNode {
+	spec, ok := c.specs[name]
+	if !ok {
+		return fsTrees[name]
+	}
+	key := network + " " + name
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		c.recent.MoveToFront(element)
+		c.mu.Unlock()
+		return element.Value.(*cachedTree).root
+	}
+	c.mu.Unlock()
+
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(key))
+	seed := int64(binary.BigEndian.Uint64(mac.Sum(nil)))
+	root := newTreeBuilder(seed, c.epoch).build(spec)
+	log.Printf("Generated %q file system for %s", name, network)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		// Another session of the same network generated it in the meantime.
+		c.recent.MoveToFront(element)
+		return element.Value.(*cachedTree).root
+	}
+	c.entries[key] = c.recent.PushFront(&cachedTree{key: key, root: root})
+	for c.recent.Len() > c.capacity {
+		oldest := c.recent.Back()
+		c.recent.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedTree).key)
+	}
+	return root
+}
+
+// len returns the number of cached trees.
+func (c *treeCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.recent.Len()
+}
+
+// visitorNetwork returns the network a visitor's trees are keyed by: their address
+// masked to the configured IPv4 or IPv6 prefix length.
+func visitorNetwork(addr net.Addr) string {
+	ip := net.ParseIP(hostOf(addr))
+	if ip == nil {
+		return hostOf(addr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%s/%d", ip4.Mask(net.CIDRMask(cfg.PerIP.IPv4Prefix, 32)), cfg.PerIP.IPv4Prefix)
+	}
+	return fmt.Sprintf("%s/%d", ip.Mask(net.CIDRMask(cfg.PerIP.IPv6Prefix, 128)), cfg.PerIP.IPv6Prefix)
+}
+
+// visitorTree returns the named tree as seen by the client at addr: its own tree when
+// per-IP trees are enabled, the shared one otherwise.
+func visitorTree(addr net.Addr, name string) *FSNode {
+	if visitorTrees == nil {
+		return fsTrees[name]
+	}
+	return visitorTrees.get(visitorNetwork(addr), name)
+}
+
+// rootFor returns the directory of the profile's tree that the client at addr sees as "/".
+func (p *userProfile) rootFor(addr net.Addr) *FSNode {
+	if visitorTrees == nil {
+		return p.root
+	}
+	if root := traverseFileSystem(visitorTree(addr, p.Tree), p.Chroot); root != nil && root.IsDir {
+		return root
+	}
+	return p.root
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io"
+	"math/rand"
+	"time"
+)
+
+//
+// Server Personas
+//
+
+// persona describes the kind of machine the honeypot pretends to be.
+type persona struct {
+	TransferRate   int           // Typical data connection throughput in bytes per second.
+	RateJitter     float64       // Fraction by which the throughput varies from chunk to chunk.
+	CommandLatency time.Duration // Typical delay before a reply.
+	LatencyJitter  time.Duration // Maximum random time added to CommandLatency.
+	// Windows imitates a Windows IIS server: case-insensitive names, backslash
+	// separators and MS-DOS style LIST lines.
+	Windows bool
+	Banner  string // Greeting sent after 220; empty uses welcomeMessage.
+	System  string // SYST reply after 215; empty uses "UNIX Type: L8".
+	// Trees maps the names of built-in trees to the trees served in their place.
+	Trees map[string]string
+}
+
+// personas are the built-in server personas, selected with the "persona" setting.
+var personas = map[string]persona{
+	// A home NAS behind a residential uplink.
+	"nas": {TransferRate: 1200 << 10, RateJitter: 0.35, CommandLatency: 40 * time.Millisecond, LatencyJitter: 60 * time.Millisecond},
+	// A rented seedbox in a data center.
+	"seedbox": {TransferRate: 40 << 20, RateJitter: 0.1, CommandLatency: 5 * time.Millisecond, LatencyJitter: 10 * time.Millisecond},
+	// An old box on a DSL line.
+	"dsl": {TransferRate: 80 << 10, RateJitter: 0.5, CommandLatency: 120 * time.Millisecond, LatencyJitter: 200 * time.Millisecond},
+	// A small business Windows server running the IIS FTP service.
+	"windows": {
+		TransferRate: 6 << 20, RateJitter: 0.2, CommandLatency: 15 * time.Millisecond, LatencyJitter: 30 * time.Millisecond,
+		Windows: true, Banner: "Microsoft FTP Service", System: "Windows_NT",
+		Trees: map[string]string{
+			"default": "windows",
+			"public":  "windows-public",
+			"admin":   "windows-admin",
+			"backup":  "windows-backup",
+		},
+	},
+}
+
+// activePersona returns the persona selected in the configuration.
+func activePersona() persona {
+	return personas[cfg.Persona]
+}
+
+// windowsPersona reports whether the server imitates a Windows server. It is false
+// before the configuration is loaded.
+func windowsPersona() bool {
+	return cfg != nil && activePersona().Windows
+}
+
+// banner returns the greeting sent to new connections.
+func (p persona) banner() string {
+	if p.Banner == "" {
+		return welcomeMessage
+	}
+	return p.Banner
+}
+
+// system returns the operating system type reported by SYST.
+func (p persona) system() string {
+	if p.System == "" {
+		return "UNIX Type: L8"
+	}
+	return p.System
+}
+
+// transferRate returns the throughput to use for the next chunk of a data transfer,
+// or zero for an unthrottled transfer.
+func transferRate() int {
+	rate, jitter := cfg.Transfer.Rate, 0.0
+	switch cfg.Transfer.Mode {
+	case "none":
+		return 0
+	case "jitter":
+		jitter = cfg.Transfer.Jitter
+	case "persona":
+		rate, jitter = activePersona().TransferRate, activePersona().RateJitter
+	}
+	if jitter > 0 {
+		rate = int(float64(rate) * (1 + jitter*(2*rand.Float64()-1)))
+	}
+	return max(rate, 1)
+}
+
+// commandLatency returns how long to wait before acting on a command.
+func commandLatency() time.Duration {
+	delay, jitter := time.Duration(cfg.Latency.Delay), time.Duration(cfg.Latency.Jitter)
+	switch cfg.Latency.Mode {
+	case "none":
+		return 0
+	case "persona":
+		delay, jitter = activePersona().CommandLatency, activePersona().LatencyJitter
+	}
+	if jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	return delay
+}
+
+// writeData sends a LIST or RETR payload over the data connection at the configured
+// transfer rate, or at the tarpit rate in tarpit mode. If fault injection cuts the
+// transfer short, errTransferDropped is returned after the partial write.
+func (s *ftpSession) writeData(w io.Writer, data []byte) error {
+	sent, dropped := s.dropTransfer(len(data))
+	rate := transferRate
+	if s.tarpitted() {
+		rate = func() int { return cfg.Tarpit.DataRate }
+	}
+	if err := throttledWrite(w, data[:sent], rate); err != nil {
+		return err
+	}
+	if dropped {
+		return errTransferDropped
+	}
+	return nil
+}
+
+// throttledWrite writes data in small chunks, pausing after each one so that it goes
+// out at roughly the rate returned by rate, in bytes per second. The rate is asked
+// again for every chunk; a rate of zero or less writes everything at once.
+func throttledWrite(w io.Writer, data []byte, rate func() int) error {
+	for len(data) > 0 {
+		bytesPerSecond := rate()
+		if bytesPerSecond <= 0 {
+			_, err := w.Write(data)
+			return err
+		}
+		// Ten chunks a second, but never less than a byte per chunk.
+		n := min(max(bytesPerSecond/10, 1), len(data))
+		if _, err := w.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(bytesPerSecond))
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+//
+// File System Snapshots
+//
+
+// fsSnapshot is the on-disk format of the generated trees.
+type fsSnapshot struct {
+	Trees map[string]*snapshotTree `json:"trees"`
+}
+
+// snapshotTree is a generated tree together with the settings it was generated from.
+type snapshotTree struct {
+	Seed  int64     `json:"seed"`  // Base seed the tree was generated with.
+	Epoch time.Time `json:"epoch"` // Time the tree is dated up to.
+	Spec  TreeSpec  `json:"spec"`  // Layout the tree was generated from.
+	// Source is the listing or archive the tree was imported from; empty if it was generated.
+	Source string  `json:"source,omitempty"`
+	Root   *FSNode `json:"root"`
+}
+
+// matches reports whether the tree was generated from spec.
+func (t *snapshotTree) matches(spec TreeSpec) bool {
+	have, err1 := json.Marshal(t.Spec)
+	want, err2 := json.Marshal(spec)
+	return err1 == nil && err2 == nil && bytes.Equal(have, want)
+}
+
+// readSnapshot reads and checks the snapshot file at name. A missing file yields a nil
+// snapshot. With foldCase, names differing only in case are rejected as duplicates.
+func readSnapshot(name string, foldCase bool) (*fsSnapshot, error) {
+	data, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot fsSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", name, err)
+	}
+	if snapshot.Trees == nil {
+		snapshot.Trees = make(map[string]*snapshotTree)
+	}
+	for treeName, tree := range snapshot.Trees {
+		if tree == nil || tree.Root == nil || !tree.Root.IsDir {
+			return nil, fmt.Errorf("%s: tree %q has no root directory", name, treeName)
+		}
+		if err := tree.Root.validate("/", foldCase); err != nil {
+			return nil, fmt.Errorf("%s: tree %q: %w", name, treeName, err)
+		}
+		tree.Root.Name = "/"
+	}
+	return &snapshot, nil
+}
+
+// validate checks the names and sizes of node, found at nodePath, and everything below it.
+// With foldCase, names differing only in case are rejected as duplicates.
+func (node *FSNode) validate(nodePath string, foldCase bool) error {
+	if node.Size < 0 {
+		return fmt.Errorf("%s: negative size", nodePath)
+	}
+	if !node.IsDir && len(node.Children) > 0 {
+		return fmt.Errorf("%s: file has children", nodePath)
+	}
+	if node.IsDir && node.Target != "" {
+		return fmt.Errorf("%s: directory has a link target", nodePath)
+	}
+	names := make(map[string]bool)
+	for _, child := range node.Children {
+		if child == nil {
+			return fmt.Errorf("%s: empty entry", nodePath)
+		}
+		if err := checkNodeName(child.Name, names, foldCase); err != nil {
+			return fmt.Errorf("%s: %w", nodePath, err)
+		}
+		if err := child.validate(path.Join(nodePath, child.Name), foldCase); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write saves the snapshot to the file name.
+func (snapshot *fsSnapshot) write(name string) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(name, append(data, '\n'))
+}
+
+// writeFileAtomic replaces the file at name with data, so readers never see a partial file.
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// runDumpFS implements the "dump-fs" subcommand, which writes the trees the server would
+// serve, from the snapshot file or freshly generated, as JSON.
+func runDumpFS(args []string) error {
+	flags := flag.NewFlagSet("dump-fs", flag.ExitOnError)
+	configPath := flags.String("config", defaultConfigPath, "path to the JSON configuration file")
+	output := flags.String("o", "-", "output file, or - for standard output")
+	flags.Parse(args)
+	config, err := loadConfig(*configPath, isFlagSet(flags, "config"))
+	if err != nil {
+		return err
+	}
+	snapshot, _, err := generateTrees(config)
+	if err != nil {
+		return err
+	}
+	if *output != "-" {
+		return snapshot.write(*output)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(snapshot)
+}
+
+// runLoadFS implements the "load-fs" subcommand, which checks a file written by dump-fs
+// (and perhaps edited since) and installs it as the snapshot the server starts from.
+func runLoadFS(args []string) error {
+	flags := flag.NewFlagSet("load-fs", flag.ExitOnError)
+	configPath := flags.String("config", defaultConfigPath, "path to the JSON configuration file")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: lovecraft-ftp load-fs [-config config.json] <file>")
+	}
+	config, err := loadConfig(*configPath, isFlagSet(flags, "config"))
+	if err != nil {
+		return err
+	}
+	if config.Snapshot == "" {
+		return errors.New("snapshots are disabled; set \"snapshot\" in the configuration")
+	}
+	snapshot, err := readSnapshot(flags.Arg(0), config.foldsCase())
+	if err != nil {
+		return err
+	}
+	if snapshot == nil {
+		return fmt.Errorf("%s does not exist", flags.Arg(0))
+	}
+	if err := snapshot.write(config.Snapshot); err != nil {
+		return err
+	}
+	fmt.Printf("Loaded %d file systems into %s; restart the server to serve them\n", len(snapshot.Trees), config.Snapshot)
+	return nil
+}
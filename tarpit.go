@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+//
+// Tarpit
+//
+
+// enableTarpit switches the session into tarpit mode, in which replies are dribbled
+// out a byte at a time, failed logins wait longer and data transfers crawl.
+func (s *ftpSession) enableTarpit(reason string) {
+	if !cfg.Tarpit.Enabled || s.tarpitReason != "" {
+		return
+	}
+	s.tarpitReason = reason
+	log.Printf("%s Tarpit enabled: %s", s.logPrefix, reason)
+	s.logEvent("tarpit", severityMedium, map[string]any{"reason": reason})
+}
+
+// tarpitted reports whether the session is in tarpit mode.
+func (s *ftpSession) tarpitted() bool {
+	return s.tarpitReason != ""
+}
+
+// checkTarpitCommand applies the per-command tarpit rules: client patterns and command rate.
+func (s *ftpSession) checkTarpitCommand(line string) {
+	if !cfg.Tarpit.Enabled || s.tarpitted() {
+		return
+	}
+	lower := strings.ToLower(line)
+	for _, pattern := range cfg.Tarpit.ClientPatterns {
+		if pattern != "" && strings.Contains(lower, strings.ToLower(pattern)) {
+			s.enableTarpit("client pattern " + pattern)
+			return
+		}
+	}
+
+	if limit := cfg.Tarpit.CommandsPerMinute; limit > 0 {
+		now := time.Now()
+		if now.Sub(s.rateWindowStart) > time.Minute {
+			s.rateWindowStart = now
+			s.rateWindowCommands = 0
+		}
+		s.rateWindowCommands++
+		if s.rateWindowCommands > limit {
+			s.enableTarpit("command rate")
+		}
+	}
+}
+
+// checkTarpitLogin applies the failed-login tarpit rule.
+func (s *ftpSession) checkTarpitLogin() {
+	if limit := cfg.Tarpit.FailedLogins; limit > 0 && s.failedLogins >= limit {
+		s.enableTarpit("failed logins")
+	}
+}
+
+// tarpitLoginDelay returns the extra delay for a failed login in tarpit mode,
+// which grows with every failure up to the configured maximum.
+func (s *ftpSession) tarpitLoginDelay() time.Duration {
+	if !s.tarpitted() {
+		return 0
+	}
+	delay := time.Duration(cfg.Tarpit.FailDelayStep) * time.Duration(s.failedLogins)
+	if maxDelay := time.Duration(cfg.Tarpit.FailDelayMax); maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// dribbleLine writes a reply one byte at a time.
+func (s *ftpSession) dribbleLine(line string) error {
+	delay := time.Duration(cfg.Tarpit.ReplyByteDelay)
+	for i := 0; i < len(line); i++ {
+		if err := s.writer.WriteByte(line[i]); err != nil {
+			return err
+		}
+		if err := s.writer.Flush(); err != nil {
+			return err
+		}
+		time.Sleep(delay)
+	}
+	return nil
+}
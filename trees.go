@@ -0,0 +1,465 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"log"
+	"math/rand"
+	"slices"
+	"strings"
+	"time"
+)
+
+//
+// File System Templates
+//
+
+// fsTrees holds the tree generated for each template, keyed by template name.
+var fsTrees = make(map[string]*FSNode)
+
+// rootTreeSpec supplies the generation settings of a tree root that leaves them unset.
+var rootTreeSpec = TreeSpec{Generator: "files", Category: "documents", Count: &Range{Min: 10, Max: 30}, Owner: "ftp", Group: "ftp"}
+
+var (
+	// homeDotfiles are the hidden files of a Unix home directory.
+	homeDotfiles = []FileSpec{
+		{Name: ".bash_history", Size: 18342},
+		{Name: ".bash_logout", Size: 220},
+		{Name: ".bashrc", Size: 3771},
+		{Name: ".profile", Size: 807},
+	}
+	// sshDir is the .ssh directory of a Unix home directory.
+	sshDir = TreeSpec{Name: ".ssh", Generator: "none", Files: []FileSpec{
+		{Name: "authorized_keys", Size: 742},
+		{Name: "id_rsa", Size: 2602},
+		{Name: "id_rsa.pub", Size: 571},
+		{Name: "known_hosts", Size: 4440},
+	}}
+)
+
+// dirSpec returns a directory spec with the given subdirectories.
+func dirSpec(name string, dirs ...TreeSpec) TreeSpec {
+	return TreeSpec{Name: name, Dirs: dirs}
+}
+
+// categoryDir returns a directory spec whose files, and those of its subdirectories, are of the given category.
+func categoryDir(name, category string, dirs ...TreeSpec) TreeSpec {
+	return TreeSpec{Name: name, Category: category, Dirs: dirs}
+}
+
+// defaultTrees returns the built-in layouts a user profile can pick its tree from.
+func defaultTrees() map[string]TreeSpec {
+	return map[string]TreeSpec{
+		// default is the home user's file dump served to everyone without a profile of their own.
+		"default": {Files: homeDotfiles, Dirs: []TreeSpec{
+			sshDir,
+			categoryDir("documents", "documents",
+				dirSpec("passwords"),
+				dirSpec("backups"),
+				dirSpec("records", dirSpec("bank"), dirSpec("bitcoin")),
+				dirSpec("harmony"),
+				dirSpec("echo"),
+				dirSpec("legacy"),
+			),
+			categoryDir("pictures", "pictures",
+				TreeSpec{Name: "porn", Generator: "porn"},
+				dirSpec("wedding_2023"),
+				dirSpec("secret"),
+			),
+			categoryDir("downloads", "downloads", dirSpec("Usenet"), dirSpec("Torrents")),
+			categoryDir("applications", "applications", dirSpec("games")),
+		}},
+		// admin is shown to administrator accounts: server configuration, site backups and a web root.
+		"admin": {Owner: "root", Group: "root", Files: append(slices.Clone(homeDotfiles),
+			FileSpec{Name: "latest-backup", Target: "backups/2024"},
+			FileSpec{Name: "public_html", Target: "/www/html"},
+		), Dirs: []TreeSpec{
+			sshDir,
+			categoryDir("backups", "backups", dirSpec("2023"), dirSpec("2024")),
+			categoryDir("config", "config", dirSpec("ssl"), dirSpec("vhosts")),
+			dirSpec("www", dirSpec("html"), dirSpec("uploads")),
+			dirSpec("logs"),
+		}},
+		// backup is shown to backup accounts: rotated archives and database dumps.
+		"backup": {Owner: "backup", Group: "backup", Dirs: []TreeSpec{
+			categoryDir("daily", "backups"),
+			categoryDir("weekly", "backups"),
+			categoryDir("databases", "backups", dirSpec("mysql"), dirSpec("postgres")),
+		}},
+		// windows is the drive of a Windows server running IIS, served as the default
+		// tree by the windows persona.
+		"windows": {Owner: "Administrators", Group: "SYSTEM", Dirs: []TreeSpec{
+			dirSpec("inetpub",
+				TreeSpec{Name: "wwwroot", Category: "config", Dirs: []TreeSpec{dirSpec("aspnet_client")}, Files: []FileSpec{
+					{Name: "web.config", Size: 2718},
+					{Name: "iisstart.htm", Size: 703},
+				}},
+				categoryDir("ftproot", "downloads"),
+				TreeSpec{Name: "logs", Generator: "none", Dirs: []TreeSpec{categoryDir("LogFiles", "config")}},
+			),
+			dirSpec("Users",
+				dirSpec("Administrator",
+					categoryDir("Desktop", "documents"),
+					categoryDir("Documents", "documents"),
+					categoryDir("Downloads", "downloads"),
+					categoryDir("Pictures", "pictures"),
+				),
+				dirSpec("Public", categoryDir("Documents", "documents")),
+			),
+			categoryDir("Backups", "backups"),
+			categoryDir("Program Files", "applications"),
+		}},
+		// windows-public is the anonymous FTP site of the windows persona, with an
+		// incoming directory for the anonymous drop box.
+		"windows-public": {Owner: "IUSR", Group: "IIS_IUSRS", Generator: "none", Dirs: []TreeSpec{
+			{Name: "Software", Generator: "files", Category: "downloads", Dirs: []TreeSpec{
+				dirSpec("Drivers"), dirSpec("Updates"), dirSpec("Tools"),
+			}},
+			{Name: "Docs", Generator: "files", Category: "documents"},
+			dirSpec("incoming"),
+		}},
+		// windows-admin is the Administrator profile shown to administrator accounts by the
+		// windows persona.
+		"windows-admin": {Owner: "Administrator", Group: "Administrators", Files: []FileSpec{
+			{Name: "NTUSER.DAT", Size: 2621440},
+			{Name: "ntuser.ini", Size: 20},
+		}, Dirs: []TreeSpec{
+			categoryDir("Desktop", "documents"),
+			categoryDir("Documents", "documents", dirSpec("Passwords"), dirSpec("Scans")),
+			categoryDir("Downloads", "downloads"),
+			categoryDir("Backups", "backups", dirSpec("2023"), dirSpec("2024")),
+			dirSpec("inetpub",
+				TreeSpec{Name: "wwwroot", Category: "config", Files: []FileSpec{{Name: "web.config", Size: 2718}}},
+				categoryDir("logs", "config"),
+			),
+		}},
+		// windows-backup is shown to backup accounts by the windows persona: Windows Server
+		// Backup sets and SQL Server dumps.
+		"windows-backup": {Owner: "Administrators", Group: "Backup Operators", Dirs: []TreeSpec{
+			categoryDir("Daily", "backups"),
+			categoryDir("Weekly", "backups"),
+			categoryDir("SQL", "backups", dirSpec("MSSQL")),
+		}},
+		// public is shown to anonymous users: a classic /pub mirror next to an
+		// empty incoming directory used as an upload drop box.
+		"public": {Generator: "none", Dirs: []TreeSpec{
+			{Name: "pub", Generator: "files", Category: "downloads", Dirs: []TreeSpec{
+				dirSpec("software"), dirSpec("drivers"), dirSpec("docs"),
+			}},
+			dirSpec("incoming"),
+		}},
+	}
+}
+
+// inherit fills the generation settings spec leaves unset from its parent directory.
+func (spec TreeSpec) inherit(parent TreeSpec) TreeSpec {
+	if spec.Generator == "" {
+		spec.Generator = parent.Generator
+	}
+	if spec.Category == "" {
+		spec.Category = parent.Category
+	}
+	if spec.Count == nil {
+		spec.Count = parent.Count
+	}
+	if spec.Size == nil {
+		spec.Size = parent.Size
+	}
+	if spec.Owner == "" {
+		spec.Owner = parent.Owner
+	}
+	if spec.Group == "" {
+		spec.Group = parent.Group
+	}
+	return spec
+}
+
+// validate checks the generator names, ranges and directory names of a tree. With
+// foldCase, names differing only in case count as duplicates.
+func (spec TreeSpec) validate(foldCase bool) error {
+	return spec.validateDir("/", foldCase)
+}
+
+// validateDir checks spec, found at dirPath, and its subdirectories.
+func (spec TreeSpec) validateDir(dirPath string, foldCase bool) error {
+	switch spec.Generator {
+	case "", "files", "porn", "none":
+	default:
+		return fmt.Errorf("%s: unknown generator %q", dirPath, spec.Generator)
+	}
+	for _, r := range []*Range{spec.Count, spec.Size} {
+		if r != nil && (r.Min < 0 || r.Max < r.Min) {
+			return fmt.Errorf("%s: invalid range %d-%d", dirPath, r.Min, r.Max)
+		}
+	}
+	names := make(map[string]bool)
+	for _, file := range spec.Files {
+		if err := checkNodeName(file.Name, names, foldCase); err != nil {
+			return fmt.Errorf("%s: %w", dirPath, err)
+		}
+		if file.Size < 0 {
+			return fmt.Errorf("%s: file %q has a negative size", dirPath, file.Name)
+		}
+	}
+	for _, dir := range spec.Dirs {
+		if err := checkNodeName(dir.Name, names, foldCase); err != nil {
+			return fmt.Errorf("%s: %w", dirPath, err)
+		}
+		if err := dir.validateDir(strings.TrimSuffix(dirPath, "/")+"/"+dir.Name, foldCase); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNodeName rejects empty, duplicate and path-like file and directory names. With
+// foldCase, names are compared ignoring case, as a Windows server would look them up.
+func checkNodeName(name string, seen map[string]bool, foldCase bool) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	key := name
+	if foldCase {
+		key = strings.ToLower(name)
+	}
+	if seen[key] {
+		return fmt.Errorf("duplicate name %q", name)
+	}
+	seen[key] = true
+	return nil
+}
+
+// treeAge is how far back the modification times of a generated tree go.
+const treeAge = 6 * 365 * 24 * time.Hour
+
+// treeBuilder generates file systems from tree specs.
+type treeBuilder struct {
+	rng *rand.Rand // Source of every random choice, so that a seed reproduces the tree.
+	now time.Time  // Latest modification time in the tree.
+}
+
+// newTreeBuilder returns a builder generating the tree of the given seed, dated up to epoch.
+func newTreeBuilder(seed int64, epoch time.Time) *treeBuilder {
+	return &treeBuilder{rng: rand.New(rand.NewSource(seed)), now: epoch}
+}
+
+// treeEpoch returns the time trees generated for config are dated up to: the configured
+// epoch, or the start of today. Dating trees by the day rather than the current time keeps
+// a seed's timestamps the same across restarts on the same day; the snapshot, or a
+// configured epoch, keeps them the same after that.
+func treeEpoch(config *Config) time.Time {
+	if !config.Epoch.IsZero() {
+		return config.Epoch.UTC().Truncate(time.Second)
+	}
+	return time.Now().UTC().Truncate(24 * time.Hour)
+}
+
+// build generates a file system from spec and returns its root node.
+func (b *treeBuilder) build(spec TreeSpec) *FSNode {
+	root := b.dir(spec, rootTreeSpec, b.now.Add(-treeAge))
+	root.Name = "/"
+	return root
+}
+
+// dir generates the directory described by spec, with settings inherited from parent.
+// Everything in it is modified between created and b.now, and the directory's own
+// modification time is that of its newest entry, as if the entries were added one by one.
+func (b *treeBuilder) dir(spec, parent TreeSpec, created time.Time) *FSNode {
+	spec = spec.inherit(parent)
+	node := &FSNode{Name: spec.Name, IsDir: true, Size: 4096, Mode: 0755, Owner: spec.Owner, Group: spec.Group, ModTime: created}
+	if strings.HasPrefix(spec.Name, ".") {
+		node.Mode = 0700
+	}
+	for _, dir := range spec.Dirs {
+		node.Children = append(node.Children, b.dir(dir, spec, b.timeBetween(created, b.now)))
+	}
+	for _, file := range spec.Files {
+		child := b.file(spec, file.Name, file.Size, created)
+		if file.Target != "" {
+			child.Target, child.Size, child.Mode = file.Target, int64(len(file.Target)), 0777
+		}
+		node.Children = append(node.Children, child)
+	}
+	if spec.Generator != "none" {
+		// Random names can repeat; a repeat is dropped, ignoring case so that the tree
+		// also works where names are case-insensitive.
+		taken := make(map[string]bool, len(node.Children))
+		for _, child := range node.Children {
+			taken[strings.ToLower(child.Name)] = true
+		}
+		numFiles := spec.Count.random(b.rng)
+		for i := int64(0); i < numFiles; i++ {
+			var fileName string
+			if spec.Generator == "porn" {
+				fileName = generatePornFilename(b.rng)
+			} else {
+				fileName = generateFileName(b.rng, spec.Category)
+			}
+			size := randomFileSize(b.rng)
+			if spec.Size != nil {
+				size = spec.Size.random(b.rng)
+			}
+			if taken[strings.ToLower(fileName)] {
+				continue
+			}
+			taken[strings.ToLower(fileName)] = true
+			node.Children = append(node.Children, b.file(spec, fileName, size, created))
+		}
+	}
+	for _, child := range node.Children {
+		if child.ModTime.After(node.ModTime) {
+			node.ModTime = child.ModTime
+		}
+	}
+	node.Links = node.linkCount()
+	return node
+}
+
+// file returns a file of the directory described by spec, created no earlier than created.
+func (b *treeBuilder) file(spec TreeSpec, name string, size int64, created time.Time) *FSNode {
+	return &FSNode{
+		Name:    name,
+		Size:    size,
+		ModTime: b.timeBetween(created, b.now),
+		Mode:    generatedFileMode(name),
+		Owner:   spec.Owner,
+		Group:   spec.Group,
+		Links:   1,
+	}
+}
+
+// timeBetween returns a random time between from and to, to the second.
+func (b *treeBuilder) timeBetween(from, to time.Time) time.Time {
+	span := to.Sub(from)
+	if span <= 0 {
+		return from
+	}
+	return from.Add(time.Duration(b.rng.Int63n(int64(span)))).Truncate(time.Second)
+}
+
+// generatedFileMode returns plausible permission bits for a file name: executables
+// and scripts are executable, and anything that looks like a secret is private.
+func generatedFileMode(name string) fs.FileMode {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".sh", ".bin", ".run", ".exe", ".app"} {
+		if strings.HasSuffix(lower, ext) {
+			return 0755
+		}
+	}
+	for _, secret := range []string{".env", ".key", ".pem", ".kdbx", "password", "wallet", "id_rsa", "_history"} {
+		if strings.Contains(lower, secret) {
+			return 0600
+		}
+	}
+	return 0644
+}
+
+// random returns a number in the range chosen with rng.
+func (r *Range) random(rng *rand.Rand) int64 {
+	return r.Min + rng.Int63n(r.Max-r.Min+1)
+}
+
+// treeSeed derives the seed of the named tree from the base seed, so that each
+// tree stays the same when other trees are added, removed or reordered.
+func treeSeed(seed int64, name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return seed ^ int64(h.Sum64())
+}
+
+// neededTrees returns the names of the trees config serves: the default tree of
+// logins no profile matches, the public tree if anonymous FTP is enabled, and every
+// profile's tree.
+func neededTrees(config *Config) []string {
+	names := []string{"default"}
+	if config.Anonymous.Enabled {
+		names = append(names, "public")
+	}
+	for _, profile := range config.Users {
+		if !slices.Contains(names, profile.Tree) {
+			names = append(names, profile.Tree)
+		}
+	}
+	return names
+}
+
+// generateTrees returns the trees needed by config. Trees found in the snapshot file are
+// reused as they are; the others are generated, and generated reports whether there were any.
+func generateTrees(config *Config) (snapshot *fsSnapshot, generated bool, err error) {
+	snapshot = &fsSnapshot{Trees: make(map[string]*snapshotTree)}
+	if config.Snapshot != "" {
+		loaded, err := readSnapshot(config.Snapshot, config.foldsCase())
+		if err != nil {
+			return nil, false, err
+		}
+		if loaded != nil {
+			snapshot = loaded
+			log.Printf("Loaded %d file systems from %s", len(snapshot.Trees), config.Snapshot)
+		}
+	}
+	seed := config.Seed
+	if seed == 0 {
+		seed = rand.Int63()
+	}
+	epoch := treeEpoch(config)
+	for _, name := range neededTrees(config) {
+		spec, ok := config.Trees[name]
+		if !ok {
+			return nil, false, fmt.Errorf("unknown tree template %q", name)
+		}
+		if tree, ok := snapshot.Trees[name]; ok {
+			if tree.Source == "" && !tree.matches(spec) {
+				log.Printf("Tree %q in %s was generated from an older layout; delete the file to regenerate it", name, config.Snapshot)
+			}
+			continue
+		}
+		if !generated {
+			log.Printf("Generating file systems with seed %d, dated up to %s", seed, epoch.Format(time.DateOnly))
+			if config.Snapshot == "" && config.Epoch.IsZero() {
+				log.Printf("File system timestamps will move with the day of each restart; set epoch or snapshot to keep them")
+			}
+			generated = true
+		}
+		root := newTreeBuilder(treeSeed(seed, name), epoch).build(spec)
+		snapshot.Trees[name] = &snapshotTree{Seed: seed, Epoch: epoch, Spec: spec, Root: root}
+		log.Printf("Generated %q file system", name)
+	}
+	return snapshot, generated, nil
+}
+
+// loadFileSystems loads or generates the tree of every template referenced by a user
+// profile, plus the default tree of logins no profile matches, and resolves the user
+// profiles.
+// Newly generated trees are saved to the snapshot file.
+func loadFileSystems() error {
+	snapshot, generated, err := generateTrees(cfg)
+	if err != nil {
+		return err
+	}
+	if generated && cfg.Snapshot != "" {
+		if err := snapshot.write(cfg.Snapshot); err != nil {
+			return fmt.Errorf("saving file systems: %w", err)
+		}
+		log.Printf("Saved file systems to %s", cfg.Snapshot)
+	}
+	// Record the seeds in the event log, so that a run can be reproduced from it later.
+	seeds := make(map[string]int64)
+	for name, tree := range snapshot.Trees {
+		fsTrees[name] = tree.Root
+		if tree.Source == "" {
+			seeds[name] = tree.Seed
+		}
+	}
+	logEvent("", "", "startup", severityInfo, map[string]any{"seeds": seeds, "snapshot": cfg.Snapshot, "persona": cfg.Persona})
+	if cfg.PerIP.Enabled {
+		visitorTrees = newTreeCache(cfg.PerIP, snapshot)
+	}
+
+	profiles, err := loadUserProfiles(cfg.Users)
+	if err != nil {
+		return err
+	}
+	userProfiles = profiles
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+//
+// Anonymous Uploads
+//
+
+// unsafeFileNameRegexp matches characters not kept in quarantined file names.
+var unsafeFileNameRegexp = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// isAnonymousUser reports whether user is one of the configured anonymous login names.
+func isAnonymousUser(user string) bool {
+	if !cfg.Anonymous.Enabled {
+		return false
+	}
+	for _, name := range cfg.Anonymous.Users {
+		if strings.EqualFold(name, user) {
+			return true
+		}
+	}
+	return false
+}
+
+// inDropBox reports whether targetPath lies in the profile's write-only upload directory.
+// Symbolic links are resolved first, so that a link into the drop box doesn't list it.
+// A targetPath that does not exist, such as that of a new upload, is judged by its parent.
+func (s *ftpSession) inDropBox(targetPath string) bool {
+	if s.profile == nil || s.profile.DropBox == "" {
+		return false
+	}
+	dropBox := traverseFileSystem(s.root, s.profile.DropBox)
+	if dropBox == nil {
+		return false
+	}
+	hops := 0
+	nodes, _ := walkPath(s.root, []*FSNode{s.root}, targetPath, true, &hops)
+	if nodes == nil {
+		hops = 0
+		nodes, _ = walkPath(s.root, []*FSNode{s.root}, path.Dir(targetPath), true, &hops)
+	}
+	return slices.Contains(nodes, dropBox)
+}
+
+// handleStor accepts an upload into quarantine. Uploads are never added to the
+// virtual tree, so a drop box stays unlistable and files cannot be downloaded again.
+func (s *ftpSession) handleStor(argument string) {
+	targetPath, ok := s.resolvePath(argument)
+	if !ok {
+		s.writeLine("553 Could not create file.")
+		return
+	}
+	if !s.allowed('w') && !s.inDropBox(targetPath) {
+		s.writeLine("550 Permission denied.")
+		return
+	}
+	if parent := traverseFileSystem(s.root, path.Dir(targetPath)); parent == nil || !parent.IsDir {
+		s.writeLine("553 Could not create file.")
+		return
+	}
+
+	if err := os.MkdirAll(cfg.Anonymous.QuarantineDir, 0700); err != nil {
+		log.Printf("%s Error creating quarantine directory: %v", s.logPrefix, err)
+		s.writeLine("451 Requested action aborted: local error in processing.")
+		return
+	}
+	name := unsafeFileNameRegexp.ReplaceAllString(path.Base(targetPath), "_")
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	quarantinePath := filepath.Join(cfg.Anonymous.QuarantineDir,
+		fmt.Sprintf("%s_%s_%s", time.Now().UTC().Format("20060102T150405Z"), s.id, name))
+	file, err := os.OpenFile(quarantinePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("%s Error creating quarantine file: %v", s.logPrefix, err)
+		s.writeLine("451 Requested action aborted: local error in processing.")
+		return
+	}
+	defer file.Close()
+
+	conn, err := s.getDataConnection()
+	if err != nil {
+		os.Remove(quarantinePath)
+		s.writeLine("425 " + err.Error())
+		return
+	}
+	s.writeLine("150 Ok to send data.")
+	hash := sha256.New()
+	limit := cfg.Anonymous.MaxUploadSize
+	size, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(conn, limit))
+	// Anything beyond the limit is only probed for, so the quarantined file stays within it.
+	truncated := false
+	if err == nil {
+		var probe [1]byte
+		n, _ := io.ReadFull(conn, probe[:])
+		truncated = n > 0
+	}
+	s.closeDataConnection()
+
+	details := map[string]any{
+		"path":       targetPath,
+		"size":       size,
+		"sha256":     hex.EncodeToString(hash.Sum(nil)),
+		"quarantine": quarantinePath,
+		"truncated":  truncated,
+	}
+	log.Printf("%s Upload of %s quarantined as %s (%d bytes)", s.logPrefix, targetPath, quarantinePath, size)
+	s.logEvent("upload", severityMedium, details)
+
+	switch {
+	case truncated:
+		s.writeLine("552 Requested file action aborted. Exceeded storage allocation.")
+	case err != nil:
+		s.writeLine("426 Connection closed; transfer aborted.")
+	default:
+		s.writeLine("226 Transfer complete.")
+	}
+}
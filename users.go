@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+//
+// User Profiles
+//
+
+// userProfile is a configured UserProfile with its chroot node and payload resolved.
+type userProfile struct {
+	UserProfile
+	root    *FSNode // Directory of the tree that the user sees as "/".
+	payload []byte  // Contents served by RETR.
+}
+
+var (
+	// userProfiles holds the resolved profiles in configuration order.
+	userProfiles []*userProfile
+	// fallbackProfile is used when no profile, not even "*", matches a user.
+	fallbackProfile *userProfile
+	// anonymousProfile is used for anonymous logins when no "anonymous" profile is configured.
+	anonymousProfile *userProfile
+)
+
+// loadUserProfiles resolves the chroot, home directory and payload of every profile.
+func loadUserProfiles(configs []UserProfile) ([]*userProfile, error) {
+	fallback, err := resolveUserProfile(UserProfile{Name: "*", Tree: "default", Permissions: "elr"})
+	if err != nil {
+		return nil, err
+	}
+	fallbackProfile = fallback
+	if cfg.Anonymous.Enabled {
+		anonymous, err := resolveUserProfile(UserProfile{Name: "anonymous", Tree: "public", Permissions: "elr", DropBox: "/incoming"})
+		if err != nil {
+			return nil, err
+		}
+		anonymousProfile = anonymous
+	}
+
+	profiles := make([]*userProfile, 0, len(configs))
+	for _, config := range configs {
+		profile, err := resolveUserProfile(config)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %w", config.Name, err)
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// resolveUserProfile looks up the chroot directory and loads the payload of a single profile.
+func resolveUserProfile(config UserProfile) (*userProfile, error) {
+	tree, ok := fsTrees[config.Tree]
+	if !ok {
+		return nil, fmt.Errorf("unknown tree template %q", config.Tree)
+	}
+	if config.Chroot == "" {
+		config.Chroot = "/"
+	}
+	root := traverseFileSystem(tree, config.Chroot)
+	if root == nil || !root.IsDir {
+		return nil, fmt.Errorf("chroot %s is not a directory of tree %q", config.Chroot, config.Tree)
+	}
+	config.Home = path.Clean("/" + config.Home)
+	if home := traverseFileSystem(root, config.Home); home == nil || !home.IsDir {
+		return nil, fmt.Errorf("home %s is not a directory below chroot %s", config.Home, config.Chroot)
+	}
+
+	if config.DropBox != "" {
+		config.DropBox = path.Clean("/" + config.DropBox)
+		if dropBox := traverseFileSystem(root, config.DropBox); dropBox == nil || !dropBox.IsDir {
+			return nil, fmt.Errorf("drop box %s is not a directory below chroot %s", config.DropBox, config.Chroot)
+		}
+	}
+
+	payload := []byte(resumeText)
+	switch {
+	case config.PayloadFile != "":
+		data, err := os.ReadFile(config.PayloadFile)
+		if err != nil {
+			return nil, err
+		}
+		payload = data
+	case config.Payload != "":
+		payload = []byte(config.Payload)
+	}
+	return &userProfile{UserProfile: config, root: root, payload: payload}, nil
+}
+
+// findUserProfile returns the profile for user: an exact (case-insensitive) name
+// match first, then the "*" wildcard, then the built-in default.
+// Anonymous users share the "anonymous" profile, or the built-in one if none is configured.
+func findUserProfile(user string) *userProfile {
+	if isAnonymousUser(user) {
+		user = "anonymous"
+	}
+	var wildcard *userProfile
+	for _, profile := range userProfiles {
+		if strings.EqualFold(profile.Name, user) {
+			return profile
+		}
+		if profile.Name == "*" && wildcard == nil {
+			wildcard = profile
+		}
+	}
+	if user == "anonymous" && anonymousProfile != nil {
+		return anonymousProfile
+	}
+	if wildcard != nil {
+		return wildcard
+	}
+	return fallbackProfile
+}
+
+// allowed reports whether the logged in user's profile grants the given permission letter.
+func (s *ftpSession) allowed(permission byte) bool {
+	return s.profile != nil && strings.IndexByte(s.profile.Permissions, permission) >= 0
+}